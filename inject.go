@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Jonchun/xmppeeker/proxy"
+	"go.uber.org/zap"
+)
+
+// maxInjectSize is the largest request body accepted by the injection endpoint
+const maxInjectSize = 1 << 20
+
+// sessionRegistry keeps track of every running Proxy so that they can be looked up by ID.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*proxy.Proxy
+}
+
+var sessions = &sessionRegistry{sessions: make(map[string]*proxy.Proxy)}
+
+func (r *sessionRegistry) Add(p *proxy.Proxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[p.ID] = p
+}
+
+func (r *sessionRegistry) Remove(p *proxy.Proxy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, p.ID)
+}
+
+func (r *sessionRegistry) Get(id string) *proxy.Proxy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// List returns all running sessions sorted by ID
+func (r *sessionRegistry) List() []*proxy.Proxy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]*proxy.Proxy, 0, len(r.sessions))
+	for _, p := range r.sessions {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// injectServer exposes the running sessions over HTTP so that elements can be injected into them.
+//
+//	GET  /sessions                                 lists running sessions
+//	POST /inject?session=<id>&direction=<C2S|S2C>  writes the XML in the request body to the session
+type injectServer struct {
+	logger *zap.SugaredLogger
+}
+
+func serveInjection(logger *zap.SugaredLogger, addr string) error {
+	s := &injectServer{logger: logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", s.handleSessions)
+	mux.HandleFunc("/inject", s.handleInject)
+	return http.ListenAndServe(addr, mux)
+}
+
+func (s *injectServer) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	for _, p := range sessions.List() {
+		fmt.Fprintf(w, "%s %s %s\n", p.ID, p.ClientAddr(), p.LogName())
+	}
+}
+
+func (s *injectServer) handleInject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p := sessions.Get(r.URL.Query().Get("session"))
+	if p == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	direction := proxy.Direction(strings.ToUpper(r.URL.Query().Get("direction")))
+	if direction != proxy.ClientToServer && direction != proxy.ServerToClient {
+		http.Error(w, fmt.Sprintf("direction must be %s or %s", proxy.ClientToServer, proxy.ServerToClient), http.StatusBadRequest)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxInjectSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := proxy.ParseInjectedElement(string(body)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.Inject(direction, string(body)); err != nil {
+		s.logger.Warnw("failed to inject element",
+			"reason", err.Error(),
+			"session", p.ID,
+			"direction", direction,
+		)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package main
+
+import "syscall"
+
+// ipv6Transparent is IPV6_TRANSPARENT from linux/in6.h, which the syscall package doesn't define
+const ipv6Transparent = 75
+
+// setTransparent sets IP_TRANSPARENT on a listening socket, which TPROXY requires to deliver connections addressed to other hosts.
+// It needs CAP_NET_ADMIN.
+func setTransparent(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		if sockErr == nil && network == "tcp6" {
+			// A dual-stack socket needs both to accept IPv4 and IPv6 connections
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// setTransparent always fails outside of Linux since TPROXY is Linux only.
+func setTransparent(network, address string, c syscall.RawConn) error {
+	return errors.New("IP_TRANSPARENT is only supported on Linux")
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/Jonchun/xmppeeker/proxy"
+	"github.com/Jonchun/xmppeeker/xmpp"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
@@ -20,21 +23,47 @@ const (
 	DefaultCertificateKey  string = "xmppeeker.key"
 	DefaultCertificatePath string = "certs"
 	DefaultLogPath         string = "logs"
+	DefaultLogTimeFormat   string = "2006-01-02 15:04:05.000000"
 )
 const (
 	ExitOK int = iota
 	ExitBadConfig
 	ExitFatal
+	ExitUsage
 )
 
-func handleConnection(logger *zap.SugaredLogger, c net.Conn, config *ProxyConfig) {
-	p := NewProxy(c, config)
-	err := p.Run()
+func handleConnection(logger *zap.SugaredLogger, c net.Conn, config *proxy.Config) {
+	// Behind a load balancer, the client's address is only known from the PROXY protocol header
+	if viper.GetBool("AcceptProxyProtocol") {
+		pc, err := proxy.ReadProxyProtocolHeader(c, time.Duration(config.ConnectTimeout)*time.Second)
+		if err != nil {
+			logger.Warnw("rejected connection without a valid PROXY protocol header",
+				"reason", err.Error(),
+				"remoteAddr", c.RemoteAddr().String(),
+			)
+			c.Close()
+			return
+		}
+		c = pc
+	}
+	p, err := proxy.New(c, nil, config)
+	if err != nil {
+		logger.Errorw("failed to start session",
+			"reason", err.Error(),
+			"clientAddr", c.RemoteAddr().String(),
+		)
+		c.Close()
+		return
+	}
+	sessions.Add(p)
+	defer sessions.Remove(p)
+	err = p.Run()
 	if err != nil {
 		logger.Errorw("error while running proxy",
 			"reason", err.Error(),
+			"session", p.ID,
 			"clientAddr", c.RemoteAddr().String(),
-			"serverAddr", config.Address,
+			"serverAddr", p.ServerAddr(),
 		)
 	}
 }
@@ -46,38 +75,99 @@ func main() {
 	sugar := logger.Sugar()
 	defer logger.Sync()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "sessions":
+			os.Exit(runSessions(sugar, os.Args[2:]))
+		case "search":
+			os.Exit(runSearch(sugar, os.Args[2:]))
+		}
+	}
+
 	configureViper(sugar)
 	pConfig := createProxyConfig(sugar)
 
-	listenAddr := fmt.Sprintf("%s:%s", viper.GetString("ListenHost"), viper.GetString("ListenPort"))
-	listener, err := net.Listen("tcp4", listenAddr)
-	if err != nil {
-		sugar.Errorw("failed to start listener",
-			"reason", err.Error(),
-		)
-		os.Exit(ExitFatal)
+	var listeners []net.Listener
+	for _, listenAddr := range listenAddresses() {
+		// tcp listens on both IPv4 and IPv6 unless the host is an address of one of them
+		listener, err := listen(sugar, "tcp", listenAddr)
+		if err != nil {
+			sugar.Errorw("failed to start listener",
+				"reason", err.Error(),
+				"listenAddr", listenAddr,
+			)
+			os.Exit(ExitFatal)
+		}
+		defer listener.Close()
+		listeners = append(listeners, listener)
 	}
-	defer listener.Close()
 
 	sugar.Infow("xmppeeker started",
-		"ListenHost", viper.GetString("ListenHost"),
-		"ListenPort", viper.GetString("ListenPort"),
+		"ListenAddresses", listenAddresses(),
 		"BackendHost", viper.GetString("BackendHost"),
 		"BackendPort", viper.GetString("BackendPort"),
+		"Transparent", viper.GetBool("Transparent"),
 	)
 
-	// Main loop
-	for {
-		c, err := listener.Accept()
-		if err != nil {
-			sugar.Errorw("error accepting connection",
-				"reason", err.Error(),
-			)
-			return
-		}
-		// TODO: Limit the number of goroutines spawned instead of infinitely creating them.
-		go handleConnection(sugar, c, pConfig)
+	if injectAddr := viper.GetString("InjectListen"); injectAddr != "" {
+		go func() {
+			if err := serveInjection(sugar, injectAddr); err != nil {
+				sugar.Errorw("injection endpoint stopped",
+					"reason", err.Error(),
+					"InjectListen", injectAddr,
+				)
+			}
+		}()
+		sugar.Infow("injection endpoint started",
+			"InjectListen", injectAddr,
+		)
+	}
+
+	// Main loop. Every listener accepts on its own goroutine, and xmppeeker stops once any of them fails.
+	errChan := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			for {
+				c, err := listener.Accept()
+				if err != nil {
+					sugar.Errorw("error accepting connection",
+						"reason", err.Error(),
+						"listenAddr", listener.Addr().String(),
+					)
+					errChan <- err
+					return
+				}
+				// TODO: Limit the number of goroutines spawned instead of infinitely creating them.
+				go handleConnection(sugar, c, pConfig)
+			}
+		}(listener)
 	}
+	<-errChan
+}
+
+// listenAddresses returns the host:port addresses to listen on. ListenHost and ListenPort are used if ListenAddresses is empty.
+func listenAddresses() []string {
+	if addrs := viper.GetStringSlice("ListenAddresses"); len(addrs) > 0 {
+		return addrs
+	}
+	return []string{net.JoinHostPort(viper.GetString("ListenHost"), viper.GetString("ListenPort"))}
+}
+
+// listen opens the listener for client connections. In transparent mode the socket is set up for TPROXY if the process is allowed to,
+// and falls back to a plain listener that only receives connections redirected with REDIRECT otherwise.
+func listen(sugar *zap.SugaredLogger, network, addr string) (net.Listener, error) {
+	if !viper.GetBool("Transparent") {
+		return net.Listen(network, addr)
+	}
+	lc := net.ListenConfig{Control: setTransparent}
+	listener, err := lc.Listen(context.Background(), network, addr)
+	if err == nil {
+		return listener, nil
+	}
+	sugar.Warnw("failed to listen for TPROXY connections. only REDIRECT will work",
+		"reason", err.Error(),
+	)
+	return net.Listen(network, addr)
 }
 
 func configureViper(sugar *zap.SugaredLogger) {
@@ -86,14 +176,38 @@ func configureViper(sugar *zap.SugaredLogger) {
 	viper.AddConfigPath(filepath.Join(AppRoot, "conf"))
 
 	viper.SetDefault("BackendPort", 5222)
-	viper.SetDefault("ListenHost", "0.0.0.0")
+	viper.SetDefault("ListenHost", "")
 	viper.SetDefault("ListenPort", 5222)
+	viper.SetDefault("ListenAddresses", []string{})
 	viper.SetDefault("ConnectTimeout", 10)
-	viper.SetDefault("LogTimeFormat", "2006-01-02 15:04:05.000000")
+	viper.SetDefault("CloseTimeout", proxy.DefaultCloseTimeout)
+	viper.SetDefault("Transparent", false)
+	viper.SetDefault("ResolveSRV", false)
+	viper.SetDefault("SRVResolver", "")
+	viper.SetDefault("Backends", []string{})
+	viper.SetDefault("BackendPolicy", proxy.PolicyRoundRobin)
+	viper.SetDefault("HealthCheckInterval", 10)
+	viper.SetDefault("UpstreamProxy", "")
+	viper.SetDefault("AcceptProxyProtocol", false)
+	viper.SetDefault("SendProxyProtocol", "")
+	viper.SetDefault("LogTimeFormat", DefaultLogTimeFormat)
 	viper.SetDefault("FileTimeFormat", "2006-01-02_15-04-05")
 	viper.SetDefault("Certificate", filepath.Join(DefaultCertificatePath, DefaultCertificate))
 	viper.SetDefault("CertificateKey", filepath.Join(DefaultCertificatePath, DefaultCertificateKey))
 	viper.SetDefault("LogPath", DefaultLogPath)
+	viper.SetDefault("LogByJID", false)
+	viper.SetDefault("SessionIndex", false)
+	viper.SetDefault("InspectStanzas", false)
+	viper.SetDefault("InjectListen", "")
+	viper.SetDefault("StripCompression", false)
+	viper.SetDefault("StripChannelBinding", false)
+	viper.SetDefault("SASLMechanisms", []string{})
+	viper.SetDefault("SuppressKeepalives", false)
+	viper.SetDefault("ComponentSecret", "")
+	viper.SetDefault("MaxElementSize", 1<<20)
+	viper.SetDefault("MaxElementDepth", 64)
+	viper.SetDefault("MaxAttributes", 64)
+	viper.SetDefault("MaxNameLength", 256)
 
 	err := viper.ReadInConfig()
 
@@ -108,8 +222,8 @@ func configureViper(sugar *zap.SugaredLogger) {
 	viper.SetEnvPrefix("PEEKER")
 	viper.AutomaticEnv()
 
-	// BackendHost is a required field
-	if beHost := viper.GetString("BackendHost"); !validator.IsAddress(beHost) {
+	// BackendHost is a required field, unless the backend is taken from each redirected connection
+	if beHost := viper.GetString("BackendHost"); !validator.IsAddress(beHost) && !(viper.GetBool("Transparent") && beHost == "") {
 		sugar.Errorw("failed to load config",
 			"reason", "'BackendHost' is invalid. must be either an IP address or hostname",
 			"value", beHost,
@@ -117,6 +231,22 @@ func configureViper(sugar *zap.SugaredLogger) {
 		os.Exit(ExitBadConfig)
 	}
 
+	if err := proxy.ValidateProxyProtocol(viper.GetString("SendProxyProtocol")); err != nil {
+		sugar.Errorw("failed to load config",
+			"reason", err.Error(),
+			"key", "SendProxyProtocol",
+		)
+		os.Exit(ExitBadConfig)
+	}
+
+	if err := proxy.ValidateUpstreamProxy(viper.GetString("UpstreamProxy")); err != nil {
+		sugar.Errorw("failed to load config",
+			"reason", err.Error(),
+			"key", "UpstreamProxy",
+		)
+		os.Exit(ExitBadConfig)
+	}
+
 	logPath := viper.GetString("LogPath")
 	if !filepath.IsAbs(logPath) {
 		logPath, err = filepath.Abs(filepath.Join(AppRoot, viper.GetString("LogPath")))
@@ -151,7 +281,7 @@ func configureViper(sugar *zap.SugaredLogger) {
 	}
 }
 
-func createProxyConfig(sugar *zap.SugaredLogger) *ProxyConfig {
+func createProxyConfig(sugar *zap.SugaredLogger) *proxy.Config {
 	cert, err := tls.LoadX509KeyPair(viper.GetString("Certificate"), viper.GetString("CertificateKey"))
 	if err != nil {
 		sugar.Warnw("failed to load x509 key pair",
@@ -174,14 +304,95 @@ func createProxyConfig(sugar *zap.SugaredLogger) *ProxyConfig {
 		}
 	}
 
-	pConfig := &ProxyConfig{
-		Address:        fmt.Sprintf("%s:%s", viper.GetString("BackendHost"), viper.GetString("BackendPort")),
-		Domain:         viper.GetString("BackendHost"),
-		ConnectTimeout: viper.GetInt("ConnectTimeout"),
-		LogPath:        viper.GetString("LogPath"),
-		LogTimeFormat:  viper.GetString("LogTimeFormat"),
-		FileTimeFormat: viper.GetString("FileTimeFormat"),
-		TLSConfig:      &tls.Config{Certificates: []tls.Certificate{cert}},
+	var hooks proxy.Hooks
+	if viper.GetBool("SessionIndex") {
+		hooks.Close = append(hooks.Close, proxy.NewSessionIndex(filepath.Join(viper.GetString("LogPath"), proxy.SessionIndexFile), sugar))
+	}
+
+	faultRules := loadFaultRules(sugar)
+	backends := loadBackendPool(sugar)
+
+	pConfig := &proxy.Config{
+		Address:           net.JoinHostPort(viper.GetString("BackendHost"), viper.GetString("BackendPort")),
+		Domain:            viper.GetString("BackendHost"),
+		ConnectTimeout:    viper.GetInt("ConnectTimeout"),
+		CloseTimeout:      viper.GetInt("CloseTimeout"),
+		Transparent:       viper.GetBool("Transparent"),
+		ResolveSRV:        viper.GetBool("ResolveSRV"),
+		SRVResolver:       viper.GetString("SRVResolver"),
+		UpstreamProxy:     viper.GetString("UpstreamProxy"),
+		SendProxyProtocol: viper.GetString("SendProxyProtocol"),
+		Backends:          backends,
+		LogPath:           viper.GetString("LogPath"),
+		LogByJID:          viper.GetBool("LogByJID"),
+		LogTimeFormat:     viper.GetString("LogTimeFormat"),
+		FileTimeFormat:    viper.GetString("FileTimeFormat"),
+		TLSConfig:         &tls.Config{Certificates: []tls.Certificate{cert}},
+		// Fault rules and injection need to see every stanza boundary, so they force stanza inspection on.
+		InspectStanzas:      viper.GetBool("InspectStanzas") || len(faultRules) > 0 || viper.GetString("InjectListen") != "",
+		StripCompression:    viper.GetBool("StripCompression"),
+		StripChannelBinding: viper.GetBool("StripChannelBinding"),
+		SASLMechanisms:      viper.GetStringSlice("SASLMechanisms"),
+		FaultRules:          faultRules,
+		SuppressKeepalives:  viper.GetBool("SuppressKeepalives"),
+		ComponentSecret:     viper.GetString("ComponentSecret"),
+		Logger:              sugar,
+		Hooks:               hooks,
+		Limits: xmpp.Limits{
+			MaxElementSize: viper.GetInt64("MaxElementSize"),
+			MaxDepth:       viper.GetInt("MaxElementDepth"),
+			MaxAttrs:       viper.GetInt("MaxAttributes"),
+			MaxNameLength:  viper.GetInt("MaxNameLength"),
+		},
 	}
 	return pConfig
 }
+
+// loadBackendPool returns the pool of Backends with its health checks running, or nil if there are none
+func loadBackendPool(sugar *zap.SugaredLogger) *proxy.BackendPool {
+	addrs := viper.GetStringSlice("Backends")
+	if len(addrs) == 0 {
+		return nil
+	}
+	pool, err := proxy.NewBackendPool(&proxy.BackendPoolConfig{
+		Backends:            addrs,
+		Policy:              viper.GetString("BackendPolicy"),
+		Domain:              viper.GetString("BackendHost"),
+		HealthCheckInterval: viper.GetInt("HealthCheckInterval"),
+		HealthCheckTimeout:  viper.GetInt("ConnectTimeout"),
+		UpstreamProxy:       viper.GetString("UpstreamProxy"),
+		ProxyProtocol:       viper.GetString("SendProxyProtocol"),
+		Logger:              sugar,
+	})
+	if err != nil {
+		sugar.Errorw("failed to load config",
+			"reason", err.Error(),
+			"key", "Backends",
+		)
+		os.Exit(ExitBadConfig)
+	}
+	go pool.RunHealthChecks(nil)
+	return pool
+}
+
+func loadFaultRules(sugar *zap.SugaredLogger) []proxy.FaultRule {
+	var rules []proxy.FaultRule
+	if err := viper.UnmarshalKey("FaultRules", &rules); err != nil {
+		sugar.Errorw("failed to load config",
+			"reason", err.Error(),
+			"key", "FaultRules",
+		)
+		os.Exit(ExitBadConfig)
+	}
+	for i, r := range rules {
+		if err := r.Validate(); err != nil {
+			sugar.Errorw("failed to load config",
+				"reason", err.Error(),
+				"key", "FaultRules",
+				"index", i,
+			)
+			os.Exit(ExitBadConfig)
+		}
+	}
+	return rules
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+func TestListenAddresses(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	tests := []struct {
+		host, port string
+		addresses  []string
+		want       []string
+	}{
+		{host: "", port: "5222", want: []string{":5222"}},
+		{host: "0.0.0.0", port: "5222", want: []string{"0.0.0.0:5222"}},
+		{host: "::1", port: "5222", want: []string{"[::1]:5222"}},
+		{host: "0.0.0.0", port: "5222", addresses: []string{"127.0.0.1:5222", "[::1]:5223"}, want: []string{"127.0.0.1:5222", "[::1]:5223"}},
+	}
+	for _, test := range tests {
+		viper.Reset()
+		viper.Set("ListenHost", test.host)
+		viper.Set("ListenPort", test.port)
+		viper.Set("ListenAddresses", test.addresses)
+		if got := listenAddresses(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("listenAddresses() = %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestListenDualStack(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.Reset()
+	// An empty host accepts IPv4 and IPv6 clients on one listener
+	l, err := listen(zap.NewNop().Sugar(), "tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+	for _, network := range []string{"tcp4", "tcp6"} {
+		host := "127.0.0.1"
+		if network == "tcp6" {
+			host = "::1"
+			if ln, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+				t.Skip("IPv6 isn't available")
+			} else {
+				ln.Close()
+			}
+		}
+		c, err := net.Dial(network, net.JoinHostPort(host, fmt.Sprint(port)))
+		if err != nil {
+			t.Errorf("%s client: %s", network, err)
+			continue
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+// Hop is one of the four legs that the session logs record traffic on, as it's written in the logs.
+type Hop string
+
+const (
+	HopClientToProxy Hop = "C->P"
+	HopProxyToClient Hop = "P->C"
+	HopServerToProxy Hop = "S->P"
+	HopProxyToServer Hop = "P->S"
+)
+
+const (
+	injectedMarker     = "[injected] "
+	keepaliveMarker    = "[keepalive]"
+	lengthMarkerFormat = "[%d bytes] "
+)
+
+// logPrefix returns what the StreamLoggers write in front of everything on h
+func (h Hop) logPrefix(injected bool) []byte {
+	if injected {
+		return []byte(" " + string(h) + " " + injectedMarker)
+	}
+	return []byte(" " + string(h) + " ")
+}
+
+// captureEntryPattern matches the start of a line that a StreamLogger wrote for a read or write, and captures its timestamp, hop,
+// injected marker and the length of data that spans lines.
+var captureEntryPattern = regexp.MustCompile(`^(.+?) (C->P|P->C|S->P|P->S) (\[injected\] )?(?:\[(\d+) bytes\] )?`)
+
+// CapturedElement is an element that was decoded from the session logs
+type CapturedElement struct {
+	Time     time.Time // When the read or write that the element started in was logged
+	Hop      Hop
+	Injected bool // Whether the element was injected by the proxy
+	Element  xmpp.Element
+}
+
+// captureEntry is a single read or write in a session log
+type captureEntry struct {
+	time     time.Time
+	hop      Hop
+	injected bool
+	data     string
+	framed   bool // The length of data was logged, so it's exact. Logs written before lengths were have to be split by line.
+	offset   int  // Offset of data in the stream of its hop
+}
+
+// ReadCapture decodes the elements in the C2P and P2S logs of the session logged under logName, and returns them in the order they were logged.
+// timeFormat is the Config.LogTimeFormat the logs were written with. A missing log is skipped, since the server may never have been connected to.
+// Elements cut off at the end of a log are left out, so that sessions can be read while they're still being logged. If a log can't be read or
+// decoded to the end, everything decoded besides it is returned along with the first error.
+func ReadCapture(logName, timeFormat string) ([]CapturedElement, error) {
+	var captured []CapturedElement
+	var firstErr error
+	for _, logType := range []string{"C2P", "P2S"} {
+		logFile := fmt.Sprintf("%s.%s.log", logName, logType)
+		entries, err := readCaptureEntries(logFile, timeFormat)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		elements, err := decodeCaptureEntries(entries)
+		captured = append(captured, elements...)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %s", logFile, err)
+		}
+	}
+	// Elements that were logged at the same time keep the order they were decoded in
+	sort.SliceStable(captured, func(i, j int) bool {
+		return captured[i].Time.Before(captured[j].Time)
+	})
+	return captured, firstErr
+}
+
+// readCaptureEntries splits a session log into the reads and writes that were logged to it.
+// Every read and write starts with a timestamp and hop at the start of a line and ends with a newline. Data that spans lines is
+// logged with its length, so a line in it that looks like the start of an entry is still read as data.
+func readCaptureEntries(logFile, timeFormat string) ([]*captureEntry, error) {
+	log, err := os.ReadFile(logFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*captureEntry
+	for pos := 0; pos < len(log); {
+		lineEnd := bytes.IndexByte(log[pos:], '\n')
+		if lineEnd < 0 {
+			lineEnd = len(log)
+		} else {
+			lineEnd += pos
+		}
+		entry, headerLen, length := parseCaptureEntry(string(log[pos:lineEnd]), timeFormat)
+		if entry == nil {
+			// Logs written before lengths were don't mark data that spans lines, so a line that doesn't start an entry continues the one before
+			if len(entries) > 0 {
+				entries[len(entries)-1].data += "\n" + string(log[pos:lineEnd])
+			}
+			pos = lineEnd + 1
+			continue
+		}
+		entries = append(entries, entry)
+		pos += headerLen
+		if length < 0 {
+			entry.data = string(log[pos:lineEnd])
+			pos = lineEnd + 1
+			continue
+		}
+		// A log that's still being written may end in the middle of the data
+		end := pos + length
+		if end > len(log) {
+			end = len(log)
+		}
+		entry.data, entry.framed = string(log[pos:end]), true
+		pos = end
+		if isKeepalive([]byte(entry.data)) && bytes.HasPrefix(log[pos:], []byte(keepaliveMarker)) {
+			pos += len(keepaliveMarker)
+		}
+		if pos < len(log) && log[pos] == '\n' {
+			pos++
+		}
+	}
+	for _, entry := range entries {
+		if entry.framed {
+			continue
+		}
+		if data := strings.TrimSuffix(entry.data, keepaliveMarker); data != entry.data && isKeepalive([]byte(data)) {
+			entry.data = data
+		}
+	}
+	return entries, nil
+}
+
+// parseCaptureEntry parses the start of an entry at the start of line. It returns the entry without its data, the length of what
+// comes before the data, and the length of the data if it was logged or -1 otherwise. The entry is nil if line doesn't start one.
+func parseCaptureEntry(line, timeFormat string) (*captureEntry, int, int) {
+	m := captureEntryPattern.FindStringSubmatch(line)
+	if m == nil {
+		return nil, 0, 0
+	}
+	t, err := time.ParseInLocation(timeFormat, m[1], time.Local)
+	if err != nil {
+		return nil, 0, 0
+	}
+	length := -1
+	if m[4] != "" {
+		if length, err = strconv.Atoi(m[4]); err != nil {
+			return nil, 0, 0
+		}
+	}
+	entry := &captureEntry{
+		time:     t,
+		hop:      Hop(m[2]),
+		injected: m[3] != "",
+	}
+	return entry, len(m[0]), length
+}
+
+// decodeCaptureEntries decodes the data of each hop as the stream it was, and timestamps every element with the entry it started in.
+// A hop that can't be decoded to the end doesn't keep the others from being decoded.
+func decodeCaptureEntries(entries []*captureEntry) ([]CapturedElement, error) {
+	streams := map[Hop][]*captureEntry{}
+	var hops []Hop
+	for _, entry := range entries {
+		if _, ok := streams[entry.hop]; !ok {
+			hops = append(hops, entry.hop)
+		}
+		streams[entry.hop] = append(streams[entry.hop], entry)
+	}
+
+	var captured []CapturedElement
+	var firstErr error
+	for _, hop := range hops {
+		stream := streams[hop]
+		var data strings.Builder
+		for _, entry := range stream {
+			entry.offset = data.Len()
+			data.WriteString(entry.data)
+		}
+
+		decoder := xmpp.NewDecoder(strings.NewReader(data.String()))
+		offset := 0
+		for {
+			e, err := decoder.NextElement()
+			if err == io.EOF || isUnexpectedEOF(err) || (err == nil && e == nil) {
+				break
+			}
+			if err != nil {
+				if firstErr == nil {
+					firstErr = fmt.Errorf("failed to decode %s: %s", hop, err)
+				}
+				break
+			}
+			// Every decoded element keeps the exact bytes it was read from, so its length is how far into the stream the next one starts.
+			// Text in front of an element at the top level of the stream is kept with it, but the element starts at its tag.
+			start := offset + tagOffset(e.XML())
+			entry := stream[sort.Search(len(stream), func(i int) bool { return stream[i].offset > start })-1]
+			offset += len(e.XML())
+			if _, ok := e.(xmpp.Whitespace); ok {
+				continue
+			}
+			captured = append(captured, CapturedElement{
+				Time:     entry.time,
+				Hop:      hop,
+				Injected: entry.injected,
+				Element:  e,
+			})
+		}
+	}
+	return captured, firstErr
+}
+
+// tagOffset returns the offset of the first tag in raw that isn't a comment or processing instruction, or 0 if there isn't one
+func tagOffset(raw string) int {
+	for i := 0; i < len(raw)-1; i++ {
+		if raw[i] == '<' && raw[i+1] != '!' && raw[i+1] != '?' {
+			return i
+		}
+	}
+	return 0
+}
+
+// isUnexpectedEOF returns true if err is from a log that ends in the middle of an element
+func isUnexpectedEOF(err error) bool {
+	syntaxErr, ok := err.(*xml.SyntaxError)
+	return err == io.ErrUnexpectedEOF || (ok && syntaxErr.Msg == "unexpected EOF")
+}
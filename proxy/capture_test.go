@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testLogTimeFormat = "2006-01-02 15:04:05.000000"
+
+// renderCapture renders every captured element as "<time> <hop> [injected] <XML>" on a line of its own
+func renderCapture(captured []CapturedElement) string {
+	var sb strings.Builder
+	for _, c := range captured {
+		sb.WriteString(c.Time.Format("05.0") + " " + string(c.Hop) + " ")
+		if c.Injected {
+			sb.WriteString(injectedMarker)
+		}
+		sb.WriteString(c.Element.XML() + "\n")
+	}
+	return sb.String()
+}
+
+func TestReadCaptureFramed(t *testing.T) {
+	// The body of m1 has a line that looks like the start of an entry
+	captured, err := ReadCapture(filepath.Join("testdata", "framed"), testLogTimeFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"00.0 C->P " + testClientHeader,
+		"00.1 P->C " + testServerHeader,
+		"01.0 C->P <message to='b@example.com' id='m1'><body>first line\n2026-10-18 20:00:09.000000 P->C <message id='fake'/>\nlast line</body></message>",
+		"03.0 C->P <iq type='get' id='i1'><query xmlns='jabber:iq:roster'/></iq>",
+		// The text in front of the presence was logged before it, but the presence starts in the entry after
+		"05.0 C->P junk<presence/>",
+		"06.0 P->C [injected] <message id='i'/>",
+	}, "\n") + "\n"
+	if got := renderCapture(captured); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestReadCaptureUnframed(t *testing.T) {
+	// Logs written before lengths were logged are split by line
+	log := strings.Join([]string{
+		"2026-10-18 20:00:00.000000 C->P " + testClientHeader,
+		"2026-10-18 20:00:01.000000 C->P <message id='m1'><body>two",
+		"lines</body></message>",
+		"2026-10-18 20:00:02.000000 C->P ",
+		"[keepalive]",
+		"2026-10-18 20:00:03.000000 C->P <presence/>",
+	}, "\n") + "\n"
+	logName := filepath.Join(t.TempDir(), "unframed")
+	if err := ioutil.WriteFile(logName+".C2P.log", []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	captured, err := ReadCapture(logName, testLogTimeFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"00.0 C->P " + testClientHeader,
+		"01.0 C->P <message id='m1'><body>two\nlines</body></message>",
+		"03.0 C->P <presence/>",
+	}, "\n") + "\n"
+	if got := renderCapture(captured); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestStreamLoggerMarksLength(t *testing.T) {
+	var log bytes.Buffer
+	l := NewStreamLogger(&StreamLoggerConfig{
+		Src:             &bytes.Buffer{},
+		Dest:            &log,
+		TimeFormat:      testLogTimeFormat,
+		WritePrefix:     HopProxyToServer.logPrefix(false),
+		WriteSuffix:     []byte("\n"),
+		KeepaliveSuffix: []byte(keepaliveMarker + "\n"),
+		MarkLength:      true,
+	})
+	message := "<message id='m1'><body>a\n2026-10-18 20:00:09.000000 P->S <message id='fake'/>\n</body></message>"
+	l.Write([]byte(testClientHeader))
+	l.Write([]byte(message))
+	l.WriteKeepalive([]byte("\n\n"))
+	l.Write([]byte("<presence/>"))
+	if !strings.Contains(log.String(), " P->S "+testClientHeader+"\n") || !strings.Contains(log.String(), " P->S [2 bytes] \n\n[keepalive]\n") {
+		t.Errorf("only data that spans lines should be marked with its length:\n%s", log.String())
+	}
+
+	logName := filepath.Join(t.TempDir(), "session")
+	if err := ioutil.WriteFile(logName+".P2S.log", log.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	captured, err := ReadCapture(logName, testLogTimeFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range captured {
+		got = append(got, c.Element.XML())
+	}
+	if want := []string{testClientHeader, message, "<presence/>"}; strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
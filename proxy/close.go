@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// DefaultCloseTimeout is how many seconds the proxy waits for the second side to close when Config.CloseTimeout isn't set
+const DefaultCloseTimeout = 5
+
+// errRouterStopped is returned by a router that was waiting for the other one when that stopped
+var errRouterStopped = errors.New("the other router stopped")
+
+// routerResult describes why the router of one direction stopped
+type routerResult struct {
+	direction Direction
+	streamEnd bool  // The sender closed its stream with </stream:stream>
+	err       error // Why reading or routing stopped. io.EOF if the sender closed its connection.
+}
+
+// clean returns true if the sender closed its side on purpose rather than the session failing.
+func (r routerResult) clean() bool {
+	return r.streamEnd || r.err == io.EOF
+}
+
+func (r routerResult) reason() string {
+	switch {
+	case r.streamEnd:
+		return "stream closed"
+	case r.err == io.EOF:
+		return "connection closed"
+	case r.err != nil:
+		return r.err.Error()
+	}
+	return "unknown"
+}
+
+// side returns which side of the proxy sends the elements travelling in direction
+func side(direction Direction) Side {
+	if direction == ClientToServer {
+		return Client
+	}
+	return Server
+}
+
+// routerStopped marks that a router stopped, which releases the other router if it's waiting in receive or signal
+func (p *Proxy) routerStopped(result routerResult) routerResult {
+	p.routerDoneOnce.Do(func() { close(p.routerDone) })
+	return result
+}
+
+// receive waits for the other router to send on c. errRouterStopped is returned if it stops instead.
+func (p *Proxy) receive(c chan bool) (bool, error) {
+	select {
+	case v := <-c:
+		return v, nil
+	case <-p.routerDone:
+		return false, errRouterStopped
+	}
+}
+
+// signal sends v on c to the other router, unless it has stopped
+func (p *Proxy) signal(c chan bool, v bool) {
+	select {
+	case c <- v:
+	case <-p.routerDone:
+	}
+}
+
+// endOfStream passes on a clean close by half-closing the receiving side of direction, so that it can finish sending
+// whatever it still has in flight before closing its own side.
+func (p *Proxy) endOfStream(result routerResult) routerResult {
+	if !result.clean() {
+		return result
+	}
+	cs := &p.server
+	if result.direction == ServerToClient {
+		cs = &p.client
+	}
+	if err := cs.closeWrite(); err != nil {
+		p.logger.Warnw("failed to half-close connection",
+			"direction", result.direction,
+			"reason", err.Error(),
+		)
+	}
+	return result
+}
+
+// waitForClose waits for the router that is still running after first stopped, for at most the configured CloseTimeout.
+func (p *Proxy) waitForClose(first routerResult, doneChan chan routerResult) {
+	peerClosed := false
+	if first.clean() {
+		closeTimeout := p.Config.CloseTimeout
+		if closeTimeout == 0 {
+			closeTimeout = DefaultCloseTimeout
+		}
+		select {
+		case second := <-doneChan:
+			peerClosed = second.clean()
+		case <-time.After(time.Duration(closeTimeout) * time.Second):
+		}
+	}
+	p.logger.Infow("session closed",
+		"closedBy", string(side(first.direction)),
+		"reason", first.reason(),
+		"peerClosed", peerClosed,
+	)
+	p.closed(side(first.direction), first.reason())
+}
+
+// closeWriter is implemented by connections that can shut down their writing side on its own, like *net.TCPConn and *tls.Conn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite shuts down the writing side of cs, so that the peer reads the end of the stream while it can still send.
+// The outermost connection is shut down first e.g. TLS sends close_notify, followed by the connection the session started with.
+func (cs *connStruct) closeWrite() error {
+	cs.sendLock.Lock()
+	defer cs.sendLock.Unlock()
+	if cw, ok := cs.Conn.(closeWriter); ok {
+		if err := cw.CloseWrite(); err != nil {
+			return err
+		}
+	}
+	// *tls.Conn doesn't shut down the connection underneath it
+	if cs.baseConn != cs.Conn {
+		if cw, ok := cs.baseConn.(closeWriter); ok {
+			return cw.CloseWrite()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRouterStoppedReleasesWaits(t *testing.T) {
+	p := newTestProxy(t, &Config{})
+	c := make(chan bool)
+	received := make(chan error, 1)
+	go func() {
+		_, err := p.receive(c)
+		received <- err
+	}()
+	signaled := make(chan struct{})
+	go func() {
+		// Nothing receives on the channel, like when the router that would have has stopped
+		p.signal(make(chan bool), true)
+		close(signaled)
+	}()
+
+	p.routerStopped(routerResult{direction: ServerToClient})
+	// Stopping twice, like both routers do, mustn't close the channel again
+	p.routerStopped(routerResult{direction: ClientToServer})
+	select {
+	case err := <-received:
+		if err != errRouterStopped {
+			t.Errorf("got %v, want errRouterStopped", err)
+		}
+	case <-time.After(testTimeout):
+		t.Error("receive still waits after the other router stopped")
+	}
+	select {
+	case <-signaled:
+	case <-time.After(testTimeout):
+		t.Error("signal still waits after the other router stopped")
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+// componentHandshake returns the handshake digest of an external component for the stream id and shared secret.
+// https://xmpp.org/extensions/xep-0114.html#protocol
+func componentHandshake(streamID, secret string) string {
+	sum := sha1.Sum([]byte(streamID + secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// componentStream returns the server's stream header as it's sent to a component. With Config.ComponentSecret set, the component
+// is given a stream id of the proxy's, so that its handshake proves that it knows the secret to the proxy rather than to the server.
+// The handshake is then recomputed for the server's stream id by handleComponentHandshake.
+func (p *Proxy) componentStream(stream *xmpp.Stream) *xmpp.Stream {
+	p.componentStreamID = stream.ID
+	if p.Config.ComponentSecret == "" {
+		return stream
+	}
+	own := *stream
+	own.ID = newSessionID()
+	p.componentStreamID = own.ID
+	return &own
+}
+
+// handleComponentHandshake checks the handshake from a component against Config.ComponentSecret, and recomputes it for the server's
+// stream id. Without a secret, the handshake is passed through as it is.
+func (p *Proxy) handleComponentHandshake(e xmpp.Element) (xmpp.Element, error) {
+	if p.Config.ComponentSecret == "" || p.server.Stream == nil {
+		return e, nil
+	}
+	digest := strings.ToLower(strings.TrimSpace(xmpp.Text(e)))
+	if digest != componentHandshake(p.componentStreamID, p.Config.ComponentSecret) {
+		// Passed on as it is, so that the server rejects it like it would without the proxy
+		p.logger.Warnw("component handshake doesn't match the configured secret",
+			"streamID", p.componentStreamID,
+		)
+		return e, nil
+	}
+	p.logger.Infow("recomputed component handshake for the server's stream id",
+		"componentStreamID", p.componentStreamID,
+		"serverStreamID", p.server.Stream.ID,
+	)
+	digest = componentHandshake(p.server.Stream.ID, p.Config.ComponentSecret)
+	return xmpp.NewGenericElement(e.Name(), fmt.Sprintf("<handshake>%s</handshake>", digest)), nil
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"regexp"
+	"testing"
+)
+
+const (
+	testComponentHeader       = `<stream:stream xmlns='jabber:component:accept' xmlns:stream='http://etherx.jabber.org/streams' to='comp.example.com'>`
+	testComponentServerHeader = `<?xml version='1.0'?><stream:stream xmlns:stream='http://etherx.jabber.org/streams' xmlns='jabber:component:accept' from='comp.example.com' id='s1'>`
+)
+
+var streamIDPattern = regexp.MustCompile(`id=["']([^"']+)["']`)
+
+func TestComponentHandshake(t *testing.T) {
+	tests := []struct {
+		name          string
+		proxySecret   string
+		clientSecret  string
+		wantOwnID     bool // The component is given a stream id other than the server's
+		wantRecompute bool // The server gets the digest for its own stream id rather than the component's
+	}{
+		{name: "matching secret", proxySecret: "secret", clientSecret: "secret", wantOwnID: true, wantRecompute: true},
+		{name: "wrong secret", proxySecret: "secret", clientSecret: "wrong", wantOwnID: true},
+		{name: "no secret", clientSecret: "secret"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handshakes := make(chan string, 1)
+			addr := acceptOnce(t, func(c *testConn) {
+				c.expect("to='comp.example.com'>")
+				c.send(testComponentServerHeader)
+				handshake := c.expect("</handshake>")
+				handshakes <- handshake
+				c.send(`<handshake/>`)
+				c.expect(testStreamEnd)
+				c.send(testStreamEnd)
+			})
+
+			c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", ComponentSecret: test.proxySecret})
+			c.send(testComponentHeader)
+			// A header with a stream id of the proxy's is encoded again, with double quotes
+			header := c.expect("<stream:stream")
+			for !streamIDPattern.MatchString(header) && !t.Failed() {
+				header += c.expect(">")
+			}
+			match := streamIDPattern.FindStringSubmatch(header)
+			if match == nil {
+				t.Fatalf("no stream id in %q", header)
+			}
+			id := match[1]
+			if ownID := id != "s1"; ownID != test.wantOwnID {
+				t.Errorf("component was given stream id %q", id)
+			}
+			digest := componentHandshake(id, test.clientSecret)
+			c.send("<handshake>" + digest + "</handshake>")
+
+			want := "<handshake>" + digest + "</handshake>"
+			if test.wantRecompute {
+				want = "<handshake>" + componentHandshake("s1", test.proxySecret) + "</handshake>"
+			}
+			if got := <-handshakes; got != want {
+				t.Errorf("server got %q, want %q", got, want)
+			}
+			c.expect(`<handshake/>`)
+			c.send(testStreamEnd)
+			c.expect(testStreamEnd)
+			c.Close()
+			waitForRun(t, done)
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"compress/zlib"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+// compressionZlib is the only Stream Compression (XEP-0138) method supported by the proxy
+const compressionZlib = "zlib"
+
+// zlibConn is a net.Conn that compresses everything written to it and decompresses everything read from it.
+// Every Write is flushed so that the peer can decode each element as soon as it is sent.
+type zlibConn struct {
+	net.Conn
+	r io.ReadCloser
+	// wLock guards w, since Close can be called while a router is still writing or half-closing
+	wLock sync.Mutex
+	w     *zlib.Writer
+}
+
+func newZlibConn(conn net.Conn) *zlibConn {
+	return &zlibConn{
+		Conn: conn,
+		w:    zlib.NewWriter(conn),
+	}
+}
+
+func (c *zlibConn) Read(p []byte) (int, error) {
+	// zlib.NewReader blocks until the zlib header arrives, so it's only created once the first read happens.
+	if c.r == nil {
+		r, err := zlib.NewReader(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		c.r = r
+	}
+	return c.r.Read(p)
+}
+
+func (c *zlibConn) Write(p []byte) (int, error) {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// CloseWrite ends the zlib stream and shuts down the writing side of the connection underneath, if it supports that.
+func (c *zlibConn) CloseWrite() error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+	if err := c.w.Close(); err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close closes the connection underneath first, so that a Write blocked on it returns instead of holding up the close.
+func (c *zlibConn) Close() error {
+	err := c.Conn.Close()
+	c.wLock.Lock()
+	c.w.Close()
+	c.wLock.Unlock()
+	return err
+}
+
+// StartCompressionWithClient wraps the connection with the client in zlib compression
+func (p *Proxy) StartCompressionWithClient() error {
+	p.client.sendLock.Lock()
+	defer p.client.sendLock.Unlock()
+	p.logger.Infow("stream compression started",
+		"leg", "client",
+		"method", compressionZlib,
+	)
+	return p.SetClientConn(newZlibConn(p.client.Conn))
+}
+
+// StartCompressionWithServer wraps the connection with the server in zlib compression
+func (p *Proxy) StartCompressionWithServer() error {
+	p.server.sendLock.Lock()
+	defer p.server.sendLock.Unlock()
+	p.logger.Infow("stream compression started",
+		"leg", "server",
+		"method", compressionZlib,
+	)
+	return p.SetServerConn(newZlibConn(p.server.Conn))
+}
+
+// offersCompression returns true if the stream features in e advertise Stream Compression.
+func offersCompression(e xmpp.Element) bool {
+	return xmpp.ChildMatcher{Space: xmpp.NSCompressFeature, Local: "compression"}.Match(e)
+}
+
+// stripCompression removes the Stream Compression feature from the stream features in e.
+func stripCompression(e xmpp.Element) (xmpp.Element, error) {
+	return xmpp.WithoutChildren(e, func(name xml.Name) bool {
+		return name.Space == xmpp.NSCompressFeature && name.Local == "compression"
+	})
+}
+
+// compressionMethod returns the method requested by a <compress/> element.
+func compressionMethod(e xmpp.Element) (string, error) {
+	methods := xmpp.Query(e, xmpp.Qualify(xmpp.NSCompress, "method"))
+	if len(methods) == 0 {
+		return "", fmt.Errorf("no compression method found: %s", e.XML())
+	}
+	return strings.TrimSpace(methods[0]), nil
+}
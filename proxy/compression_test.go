@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"testing"
+)
+
+const (
+	testCompressionFeatures = `<stream:features><compression xmlns='http://jabber.org/features/compress'><method>zlib</method></compression></stream:features>`
+	testCompress            = `<compress xmlns='http://jabber.org/protocol/compress'><method>zlib</method></compress>`
+	testCompressed          = `<compressed xmlns='http://jabber.org/protocol/compress'/>`
+)
+
+// compressed returns c with zlib layered on top of its connection, like after <compressed/>
+func compressed(c *testConn) *testConn {
+	return newTestConn(c.t, newZlibConn(c.Conn))
+}
+
+func TestCompressionSession(t *testing.T) {
+	message := `<message to='b@example.com' id='m1'><body>hi</body></message>`
+	reply := `<message from='b@example.com' id='m2'><body>hello</body></message>`
+	for _, inspect := range []bool{false, true} {
+		t.Run(map[bool]string{false: "byte-level copy", true: "inspected"}[inspect], func(t *testing.T) {
+			addr := acceptOnce(t, func(c *testConn) {
+				serverLogin(c, testCompressionFeatures)
+				c.expect(testCompress)
+				c.send(testCompressed)
+				zc := compressed(c)
+				zc.expect("version='1.0'>")
+				zc.send(testServerHeader + `<stream:features/>`)
+				zc.expect(message)
+				zc.send(reply)
+				zc.expect(testStreamEnd)
+				zc.send(testStreamEnd)
+				zc.Close()
+			})
+			c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", InspectStanzas: inspect})
+			clientLogin(c, testCompressionFeatures)
+			c.send(testCompress)
+			c.expect(testCompressed)
+			zc := compressed(c)
+			zc.send(testClientHeader)
+			zc.expect(`<stream:features/>`)
+			zc.send(message)
+			zc.expect(reply)
+			zc.send(testStreamEnd)
+			zc.expect(testStreamEnd)
+			// Both ends of the unbuffered pipe would block writing their zlib trailers, so skip ours
+			c.Close()
+			if err := waitForRun(t, done); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCompressionUnsupportedMethod(t *testing.T) {
+	serverGot := make(chan string, 1)
+	addr := acceptOnce(t, func(c *testConn) {
+		serverLogin(c, testCompressionFeatures)
+		// The request never reaches the server, which only sees the end of the stream
+		serverGot <- c.expect(testStreamEnd)
+		c.send(testStreamEnd)
+	})
+	c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", InspectStanzas: true})
+	clientLogin(c, testCompressionFeatures)
+	c.send(`<compress xmlns='http://jabber.org/protocol/compress'><method>lzw</method></compress>`)
+	c.expect(`<failure xmlns='http://jabber.org/protocol/compress'><unsupported-method/></failure>`)
+	c.send(testStreamEnd)
+	c.expect(testStreamEnd)
+	c.Close()
+	if err := waitForRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-serverGot; got != testStreamEnd {
+		t.Errorf("server got %q, want only the end of the stream", got)
+	}
+}
+
+func TestStripCompression(t *testing.T) {
+	addr := acceptOnce(t, func(c *testConn) {
+		serverLogin(c, testCompressionFeatures)
+		c.expect(testStreamEnd)
+		c.send(testStreamEnd)
+	})
+	c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", StripCompression: true})
+	clientLogin(c, "</stream:features>")
+	c.send(testStreamEnd)
+	c.expect(testStreamEnd)
+	c.Close()
+	if err := waitForRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompressionMethod(t *testing.T) {
+	if method, err := compressionMethod(decodeElement(t, `<compress xmlns='http://jabber.org/protocol/compress'><method> zlib </method></compress>`)); err != nil || method != compressionZlib {
+		t.Errorf("got method %q, %v, want zlib", method, err)
+	}
+	if _, err := compressionMethod(decodeElement(t, `<compress xmlns='http://jabber.org/protocol/compress'/>`)); err == nil {
+		t.Error("compress without a method was accepted")
+	}
+	// A method of another namespace isn't a compression method
+	if _, err := compressionMethod(decodeElement(t, `<compress xmlns='http://jabber.org/protocol/compress'><method xmlns='urn:example'>zlib</method></compress>`)); err == nil {
+		t.Error("method of another namespace was accepted")
+	}
+}
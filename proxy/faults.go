@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/rand"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+	"go.uber.org/zap"
+)
+
+// Direction describes which way an element is travelling through the proxy.
+type Direction string
+
+const (
+	ClientToServer Direction = "C2S"
+	ServerToClient Direction = "S2C"
+)
+
+// Side is one of the two connections of a session.
+type Side string
+
+const (
+	Client Side = "client"
+	Server Side = "server"
+)
+
+// Fault actions supported by a FaultRule
+const (
+	FaultDelay     string = "delay"
+	FaultDrop      string = "drop"
+	FaultDuplicate string = "duplicate"
+	FaultReorder   string = "reorder"
+	FaultClose     string = "close"
+)
+
+// DefaultReorderDelay is how many milliseconds the reorder action holds an element for at most, if the rule doesn't set a Delay
+const DefaultReorderDelay = 1000
+
+// errFaultClose is returned by a router once a fault rule has closed the stream, which ends its direction like a closing tag from the sender would
+var errFaultClose = errors.New("stream closed by fault rule")
+
+// streamErrorCondition matches the defined conditions of stream errors e.g. policy-violation
+var streamErrorCondition = regexp.MustCompile(`^[a-z]+(-[a-z]+)*$`)
+
+// FaultRule describes a fault that is injected into the elements travelling in one direction.
+// Rules only apply to the elements that the proxy forwards without handling them itself, which are stanzas and any other element
+// but stream headers, STARTTLS, SASL, stream features, stream compression, Stream Management and component handshakes.
+type FaultRule struct {
+	Direction   Direction // Direction of the elements the rule applies to
+	Namespace   string    // Namespace of the element to match. Empty matches any namespace.
+	Element     string    // Local name of the element to match. Empty matches any name.
+	Type        string    // Type attribute of the stanza to match e.g. set. Empty matches any type.
+	Child       string    // Namespace of a child the element must have e.g. jabber:iq:roster. Empty matches any children.
+	Action      string    // One of delay, drop, duplicate, reorder or close
+	Delay       int       // Milliseconds to hold the element for the delay action, and at most for the reorder action
+	StreamError string    // Condition of a <stream:error/> sent before the close action closes the stream e.g. policy-violation. Empty sends none.
+	Probability *float64  // Chance between 0 and 1 that a matching element is faulted. Unset faults every matching element, 0 none.
+	Nth         int       // Only fault the Nth matching element. 0 faults every matching element.
+}
+
+// Validate checks that r is a usable rule
+func (r FaultRule) Validate() error {
+	switch r.Direction {
+	case ClientToServer, ServerToClient:
+	default:
+		return fmt.Errorf("invalid fault direction %q. must be %s or %s", r.Direction, ClientToServer, ServerToClient)
+	}
+	switch r.Action {
+	case FaultDelay, FaultDrop, FaultDuplicate, FaultReorder, FaultClose:
+	default:
+		return fmt.Errorf("invalid fault action %q", r.Action)
+	}
+	if r.Probability != nil && (*r.Probability < 0 || *r.Probability > 1) {
+		return fmt.Errorf("invalid fault probability %v. must be between 0 and 1", *r.Probability)
+	}
+	if r.Delay < 0 || r.Nth < 0 {
+		return errors.New("fault delay and nth must not be negative")
+	}
+	if r.StreamError != "" && (r.Action != FaultClose || !streamErrorCondition.MatchString(r.StreamError)) {
+		return fmt.Errorf("invalid fault stream error %q. must be a stream error condition, for the close action", r.StreamError)
+	}
+	return nil
+}
+
+// Match returns true if e is targeted by r
+func (r FaultRule) Match(e xmpp.Element) bool {
+	return r.Matcher().Match(e)
+}
+
+// Matcher returns an xmpp.Matcher that matches every element targeted by r
+func (r FaultRule) Matcher() xmpp.Matcher {
+	m := xmpp.And(xmpp.Not(xmpp.NameMatcher(xmpp.StreamEnd{}.Name())), xmpp.Not(xmpp.WhitespaceMatcher{}))
+	if r.Namespace != "" {
+		m = append(m, xmpp.SpaceMatcher(r.Namespace))
+	}
+	if r.Element != "" {
+		m = append(m, xmpp.LocalMatcher(r.Element))
+	}
+	if r.Type != "" {
+		m = append(m, xmpp.TypeMatcher(r.Type))
+	}
+	if r.Child != "" {
+		m = append(m, xmpp.ChildMatcher{Space: r.Child})
+	}
+	return m
+}
+
+// faultRuleState tracks how many times a FaultRule has matched within a session
+type faultRuleState struct {
+	FaultRule
+	matcher xmpp.Matcher
+	matches int
+}
+
+// faultHandler is an xmpp.Handler that applies FaultRules to elements before passing them to the next Handler.
+// A faultHandler is called from the router goroutine of a single direction, and from the timer that forwards a reordered element
+// if nothing follows it.
+type faultHandler struct {
+	direction Direction
+	rules     []*faultRuleState
+	next      xmpp.Handler
+	mu        sync.Mutex
+	held      xmpp.Element // The element held back by a reorder
+	holds     int          // Counts the elements held back, so that a timer only forwards the one it was started for
+	logger    *zap.SugaredLogger
+	rand      *rand.Rand
+}
+
+// newFaultHandler wraps next with the rules in rules that apply to direction. If no rules apply, next is returned unchanged.
+func newFaultHandler(direction Direction, rules []FaultRule, next xmpp.Handler, logger *zap.SugaredLogger) xmpp.Handler {
+	h := &faultHandler{
+		direction: direction,
+		next:      next,
+		logger:    logger,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, r := range rules {
+		if r.Direction == direction {
+			h.rules = append(h.rules, &faultRuleState{FaultRule: r, matcher: r.Matcher()})
+		}
+	}
+	if len(h.rules) == 0 {
+		return next
+	}
+	return h
+}
+
+func (h *faultHandler) HandleElement(e xmpp.Element) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := e.(xmpp.StreamEnd); ok {
+		// Anything held back is forwarded before the stream is closed
+		if err := h.flush(); err != nil {
+			return err
+		}
+		return h.next.HandleElement(e)
+	}
+	for _, r := range h.rules {
+		if !r.matcher.Match(e) {
+			continue
+		}
+		r.matches++
+		if r.Nth > 0 && r.matches != r.Nth {
+			continue
+		}
+		if r.Probability != nil && h.rand.Float64() >= *r.Probability {
+			continue
+		}
+		h.logger.Infow("injecting fault",
+			"direction", h.direction,
+			"action", r.Action,
+			"element", e.Name().Local,
+			"match", r.matches,
+		)
+		switch r.Action {
+		case FaultDelay:
+			// The lock is released while sleeping, so that an element held back by a reorder is still forwarded in time
+			h.mu.Unlock()
+			time.Sleep(time.Duration(r.Delay) * time.Millisecond)
+			h.mu.Lock()
+			return h.forward(e)
+		case FaultDrop:
+			return nil
+		case FaultDuplicate:
+			if err := h.forward(e); err != nil {
+				return err
+			}
+			return h.next.HandleElement(e)
+		case FaultReorder:
+			// Only one element is held back at a time. Anything matching while an element is held is forwarded normally.
+			if h.held != nil {
+				return h.forward(e)
+			}
+			h.held = e
+			h.holds++
+			delay := r.Delay
+			if delay == 0 {
+				delay = DefaultReorderDelay
+			}
+			hold := h.holds
+			time.AfterFunc(time.Duration(delay)*time.Millisecond, func() { h.release(hold) })
+			return nil
+		case FaultClose:
+			return h.close(r.StreamError)
+		}
+	}
+	return h.forward(e)
+}
+
+// release forwards the element held back by the hold'th reorder if no element has followed it yet
+func (h *faultHandler) release(hold int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.held == nil || h.holds != hold {
+		return
+	}
+	h.logger.Infow("forwarding reordered element that nothing followed",
+		"direction", h.direction,
+		"element", h.held.Name().Local,
+	)
+	if err := h.flush(); err != nil {
+		h.logger.Warnw("failed to forward reordered element",
+			"direction", h.direction,
+			"reason", err.Error(),
+		)
+	}
+}
+
+// close closes the stream of the receiving side as if the sender had, after a stream error with condition unless it's empty.
+func (h *faultHandler) close(condition string) error {
+	if err := h.flush(); err != nil {
+		return err
+	}
+	if condition != "" {
+		streamError := fmt.Sprintf("<stream:error><%s xmlns='%s'/></stream:error>", condition, xmpp.NSStreams)
+		if err := h.next.HandleElement(xmpp.NewGenericElement(xml.Name{Space: xmpp.NSStream, Local: "error"}, streamError)); err != nil {
+			return err
+		}
+	}
+	if err := h.next.HandleElement(xmpp.StreamEnd{}); err != nil {
+		return err
+	}
+	return errFaultClose
+}
+
+// forward passes e to the next Handler, followed by any element held back by a reorder.
+func (h *faultHandler) forward(e xmpp.Element) error {
+	if err := h.next.HandleElement(e); err != nil {
+		return err
+	}
+	return h.flush()
+}
+
+// flush forwards the element held back by a reorder, if there is one
+func (h *faultHandler) flush() error {
+	if h.held == nil {
+		return nil
+	}
+	held := h.held
+	h.held = nil
+	return h.next.HandleElement(held)
+}
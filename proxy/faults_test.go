@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+	"go.uber.org/zap"
+)
+
+// forwardRecorder is the Handler behind a faultHandler, which records what was forwarded
+type forwardRecorder struct {
+	mu        sync.Mutex
+	forwarded []string
+}
+
+func (f *forwardRecorder) HandleElement(e xmpp.Element) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.forwarded = append(f.forwarded, e.XML())
+	return nil
+}
+
+func (f *forwardRecorder) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return strings.Join(f.forwarded, "")
+}
+
+// handleFaults passes elements through a faultHandler with rules and returns what was forwarded, and the error of the last element
+func handleFaults(t *testing.T, rules []FaultRule, elements ...string) (*forwardRecorder, error) {
+	t.Helper()
+	f := &forwardRecorder{}
+	h := newFaultHandler(ClientToServer, rules, f, zap.NewNop().Sugar())
+	var err error
+	for _, s := range elements {
+		if s == testStreamEnd {
+			err = h.HandleElement(xmpp.StreamEnd{})
+			continue
+		}
+		err = h.HandleElement(decodeElement(t, s))
+	}
+	return f, err
+}
+
+// probability returns a pointer to p for FaultRule.Probability
+func probability(p float64) *float64 {
+	return &p
+}
+
+func TestFaultActions(t *testing.T) {
+	first, second := `<message id='1'/>`, `<message id='2'/>`
+	tests := []struct {
+		name string
+		rule FaultRule
+		want string
+	}{
+		{name: "drop", rule: FaultRule{Action: FaultDrop, Nth: 1}, want: second},
+		{name: "duplicate", rule: FaultRule{Action: FaultDuplicate, Nth: 1}, want: first + first + second},
+		{name: "reorder", rule: FaultRule{Action: FaultReorder, Nth: 1}, want: second + first},
+		{name: "other direction", rule: FaultRule{Direction: ServerToClient, Action: FaultDrop}, want: first + second},
+		{name: "other element", rule: FaultRule{Element: "iq", Action: FaultDrop}, want: first + second},
+		{name: "probability unset", rule: FaultRule{Action: FaultDrop}},
+		{name: "probability 1", rule: FaultRule{Action: FaultDrop, Probability: probability(1)}},
+		{name: "probability 0", rule: FaultRule{Action: FaultDrop, Probability: probability(0)}, want: first + second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.rule.Direction == "" {
+				test.rule.Direction = ClientToServer
+			}
+			f, err := handleFaults(t, []FaultRule{test.rule}, first, second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.String() != test.want {
+				t.Errorf("forwarded %q, want %q", f.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestFaultReorderFlush(t *testing.T) {
+	held := `<message id='1'/>`
+	rule := FaultRule{Direction: ClientToServer, Action: FaultReorder, Delay: 50}
+
+	// Nothing follows the held element, so it's forwarded once the delay has passed
+	f, _ := handleFaults(t, []FaultRule{rule}, held)
+	if f.String() != "" {
+		t.Errorf("forwarded %q before the delay passed", f.String())
+	}
+	deadline := time.Now().Add(testTimeout)
+	for f.String() == "" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if f.String() != held {
+		t.Errorf("forwarded %q, want the held element", f.String())
+	}
+
+	// The held element is forwarded before the end of the stream
+	rule.Delay = int(testTimeout / time.Millisecond)
+	f, _ = handleFaults(t, []FaultRule{rule}, held, testStreamEnd)
+	if want := held + testStreamEnd; f.String() != want {
+		t.Errorf("forwarded %q, want %q", f.String(), want)
+	}
+}
+
+func TestFaultDelayReleasesReorder(t *testing.T) {
+	held, delayed := `<message id='1'/>`, `<iq type='get' id='2'/>`
+	rules := []FaultRule{
+		{Direction: ClientToServer, Element: "message", Action: FaultReorder, Delay: 10},
+		{Direction: ClientToServer, Element: "iq", Action: FaultDelay, Delay: 300},
+	}
+	// The held element isn't followed by anything while the iq is delayed, so it's forwarded first
+	f, err := handleFaults(t, rules, held, delayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := held + delayed; f.String() != want {
+		t.Errorf("forwarded %q, want %q", f.String(), want)
+	}
+}
+
+func TestFaultClose(t *testing.T) {
+	tests := []struct {
+		name        string
+		streamError string
+		want        string
+	}{
+		{name: "without stream error", want: testStreamEnd},
+		{name: "with stream error", streamError: "policy-violation", want: "<stream:error><policy-violation xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>" + testStreamEnd},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := FaultRule{Direction: ClientToServer, Element: "iq", Action: FaultClose, StreamError: test.streamError}
+			f, err := handleFaults(t, []FaultRule{rule}, `<iq type='get' id='1'/>`)
+			if err != errFaultClose {
+				t.Errorf("got %v, want errFaultClose", err)
+			}
+			if f.String() != test.want {
+				t.Errorf("forwarded %q, want %q", f.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestFaultCloseSession(t *testing.T) {
+	iq := `<iq type='get' id='1'><query xmlns='jabber:iq:roster'/></iq>`
+	streamError := "<stream:error><policy-violation xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error>"
+	serverGot := make(chan string, 1)
+	addr := acceptOnce(t, func(c *testConn) {
+		serverLogin(c, `<stream:features/>`)
+		serverGot <- c.expect(testStreamEnd)
+		c.send(testStreamEnd)
+	})
+
+	rule := FaultRule{Direction: ClientToServer, Element: "iq", Action: FaultClose, StreamError: "policy-violation"}
+	c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", InspectStanzas: true, FaultRules: []FaultRule{rule}})
+	clientLogin(c, `<stream:features/>`)
+	c.send(iq)
+	// The server answers the closed stream by closing its own, which reaches the client
+	c.expect(testStreamEnd)
+	c.Close()
+	if err := waitForRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-serverGot; got != streamError+testStreamEnd {
+		t.Errorf("server got %q, want the stream error and the end of the stream", got)
+	}
+}
+
+func TestFaultRuleValidate(t *testing.T) {
+	valid := FaultRule{Direction: ClientToServer, Action: FaultClose, StreamError: "policy-violation"}
+	if err := valid.Validate(); err != nil {
+		t.Error(err)
+	}
+	for _, r := range []FaultRule{
+		{Direction: ClientToServer, Action: FaultDrop, StreamError: "policy-violation"},
+		{Direction: ClientToServer, Action: FaultClose, StreamError: "<x/>"},
+		{Direction: "C2C", Action: FaultDrop},
+		{Direction: ClientToServer, Action: "explode"},
+		{Direction: ClientToServer, Action: FaultDrop, Probability: probability(1.5)},
+	} {
+		if err := r.Validate(); err == nil {
+			t.Errorf("%+v is valid, want an error", r)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"crypto/tls"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+// Hooks holds the hooks of Config, one list per event, so a value that doesn't implement the event's interface fails to compile.
+// A value implementing several of the interfaces below is added to each list it should be called from.
+// Hooks are called in order from the goroutine handling the event, so they must not block the session for long.
+type Hooks struct {
+	StreamOpen       []StreamOpenHook
+	TLSUpgrade       []TLSUpgradeHook
+	SASLResult       []SASLResultHook
+	ResourceBound    []ResourceBoundHook
+	ElementForwarded []ElementForwardedHook
+	Close            []CloseHook
+}
+
+// StreamOpenHook is called whenever a side opens or restarts its stream, after the header was forwarded.
+type StreamOpenHook interface {
+	StreamOpened(p *Proxy, direction Direction, stream *xmpp.Stream)
+}
+
+// TLSUpgradeHook is called once the connection with side has completed its TLS handshake.
+type TLSUpgradeHook interface {
+	TLSUpgraded(p *Proxy, side Side, state tls.ConnectionState)
+}
+
+// SASLResultHook is called when the server answers a SASL exchange with <success/> or <failure/>.
+// condition is the defined condition of a failure and empty on success.
+type SASLResultHook interface {
+	SASLResult(p *Proxy, mechanism string, success bool, condition string)
+}
+
+// ResourceBoundHook is called when the server answers the client's bind request with the full JID of the session.
+type ResourceBoundHook interface {
+	ResourceBound(p *Proxy, jid string)
+}
+
+// ElementForwardedHook is called for every element written to the receiving side of direction.
+// Once the session falls back to a byte-level copy after SASL success, elements are no longer decoded and the hook stops being called.
+type ElementForwardedHook interface {
+	ElementForwarded(p *Proxy, direction Direction, e xmpp.Element)
+}
+
+// CloseHook is called once the session has ended, with the side that stopped first and why.
+// It's also called if the server couldn't be connected to, with Server and the error. Proxy.ConnectError tells these apart.
+type CloseHook interface {
+	Closed(p *Proxy, closedBy Side, reason string)
+}
+
+// needJID reports whether any of h needs the JID the client binds. A session that isn't inspected only learns it if it waits
+// for the bind result before falling back to the byte-level copy.
+func (h Hooks) needJID() bool {
+	if len(h.ResourceBound) > 0 {
+		return true
+	}
+	for _, c := range h.Close {
+		if _, ok := c.(*SessionIndex); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) streamOpened(direction Direction, stream *xmpp.Stream) {
+	for _, h := range p.Config.Hooks.StreamOpen {
+		h.StreamOpened(p, direction, stream)
+	}
+}
+
+func (p *Proxy) tlsUpgraded(side Side, state tls.ConnectionState) {
+	p.mu.Lock()
+	if side == Server {
+		p.server.tlsState = &state
+	} else {
+		p.client.tlsState = &state
+	}
+	p.mu.Unlock()
+	for _, h := range p.Config.Hooks.TLSUpgrade {
+		h.TLSUpgraded(p, side, state)
+	}
+}
+
+func (p *Proxy) saslResult(success bool, condition string) {
+	for _, h := range p.Config.Hooks.SASLResult {
+		h.SASLResult(p, p.saslMechanism, success, condition)
+	}
+}
+
+func (p *Proxy) resourceBound(jid string) {
+	for _, h := range p.Config.Hooks.ResourceBound {
+		h.ResourceBound(p, jid)
+	}
+}
+
+func (p *Proxy) elementForwarded(direction Direction, e xmpp.Element) {
+	for _, h := range p.Config.Hooks.ElementForwarded {
+		h.ElementForwarded(p, direction, e)
+	}
+}
+
+func (p *Proxy) closed(closedBy Side, reason string) {
+	for _, h := range p.Config.Hooks.Close {
+		h.Closed(p, closedBy, reason)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+// hookRecorder implements every hook interface except TLSUpgradeHook and records the events it's called for.
+type hookRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *hookRecorder) record(format string, args ...interface{}) {
+	r.mu.Lock()
+	r.events = append(r.events, fmt.Sprintf(format, args...))
+	r.mu.Unlock()
+}
+
+func (r *hookRecorder) StreamOpened(p *Proxy, direction Direction, stream *xmpp.Stream) {
+	r.record("open %s", direction)
+}
+
+func (r *hookRecorder) SASLResult(p *Proxy, mechanism string, success bool, condition string) {
+	r.record("sasl %s %t", mechanism, success)
+}
+
+func (r *hookRecorder) ResourceBound(p *Proxy, jid string) {
+	r.record("bound %s", jid)
+}
+
+func (r *hookRecorder) ElementForwarded(p *Proxy, direction Direction, e xmpp.Element) {}
+
+func (r *hookRecorder) Closed(p *Proxy, closedBy Side, reason string) {
+	r.record("closed")
+}
+
+func TestHooksCalledPerList(t *testing.T) {
+	addr := acceptOnce(t, func(c *testConn) {
+		serverLogin(c, testBindFeatures)
+		c.expect(testBindRequest)
+		c.send(testBindResult)
+		c.expect(testStreamEnd)
+		c.send(testStreamEnd)
+	})
+	r := &hookRecorder{}
+	// The recorder is left out of StreamOpen, so it must only be called for the events of the lists it's in
+	hooks := Hooks{
+		SASLResult:    []SASLResultHook{r},
+		ResourceBound: []ResourceBoundHook{r},
+		Close:         []CloseHook{r},
+	}
+	c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", InspectStanzas: true, Hooks: hooks})
+	clientLogin(c, testBindFeatures)
+	c.send(testBindRequest)
+	c.expect(testBindResult)
+	c.send(testStreamEnd)
+	c.expect(testStreamEnd)
+	c.Close()
+	if err := waitForRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"sasl PLAIN true", "bound a@example.com/r", "closed"}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !reflect.DeepEqual(r.events, want) {
+		t.Errorf("got events %q, want %q", r.events, want)
+	}
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SessionIndexFile is the name of the session index in Config.LogPath
+const SessionIndexFile = "sessions.jsonl"
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// TLSInfo describes the TLS connection with one side of a session
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+}
+
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+	version, ok := tlsVersions[state.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", state.Version)
+	}
+	return &TLSInfo{Version: version, CipherSuite: tls.CipherSuiteName(state.CipherSuite)}
+}
+
+// SessionRecord is the metadata of a finished session kept in a SessionIndex
+type SessionRecord struct {
+	ID              string    `json:"id"`
+	ClientAddr      string    `json:"clientAddr"`
+	BackendAddr     string    `json:"backendAddr"`
+	JID             string    `json:"jid,omitempty"` // Bare JID
+	Resource        string    `json:"resource,omitempty"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	BytesFromClient int64     `json:"bytesFromClient"`
+	BytesFromServer int64     `json:"bytesFromServer"`
+	ClientTLS       *TLSInfo  `json:"clientTLS,omitempty"`
+	ServerTLS       *TLSInfo  `json:"serverTLS,omitempty"`
+	ClosedBy        string    `json:"closedBy"`
+	CloseReason     string    `json:"closeReason"`
+	LogName         string    `json:"logName,omitempty"`
+	Error           string    `json:"error,omitempty"` // Why connecting to the server failed, if it did
+}
+
+// SessionIndex is a CloseHook that appends a SessionRecord for every session that ends to a file, one JSON object per line.
+type SessionIndex struct {
+	path   string
+	logger *zap.SugaredLogger
+	mu     sync.Mutex
+}
+
+// NewSessionIndex returns a SessionIndex that writes to the file at path. Failed writes are logged to logger, which may be nil.
+func NewSessionIndex(path string, logger *zap.SugaredLogger) *SessionIndex {
+	if logger == nil {
+		logger = zap.NewNop().Sugar()
+	}
+	return &SessionIndex{path: path, logger: logger}
+}
+
+// Closed records the session p
+func (i *SessionIndex) Closed(p *Proxy, closedBy Side, reason string) {
+	bare, resource := splitJID(p.JID())
+	record := SessionRecord{
+		ID:              p.ID,
+		ClientAddr:      p.ClientAddr().String(),
+		BackendAddr:     p.ServerAddr(),
+		JID:             bare,
+		Resource:        resource,
+		Start:           p.StartTime(),
+		End:             time.Now(),
+		BytesFromClient: p.BytesSent(ClientToServer),
+		BytesFromServer: p.BytesSent(ServerToClient),
+		ClientTLS:       newTLSInfo(p.TLSState(Client)),
+		ServerTLS:       newTLSInfo(p.TLSState(Server)),
+		ClosedBy:        string(closedBy),
+		CloseReason:     reason,
+		LogName:         p.LogName(),
+	}
+	if err := p.ConnectError(); err != nil {
+		record.Error = err.Error()
+	}
+	if err := i.add(record); err != nil {
+		i.logger.Warnw("failed to add session to the index",
+			"session", p.ID,
+			"index", i.path,
+			"reason", err.Error(),
+		)
+	}
+}
+
+func (i *SessionIndex) add(record SessionRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	f, err := os.OpenFile(i.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// ReadSessionIndex returns the records of the session index at path in the order the sessions ended
+func ReadSessionIndex(path string) ([]SessionRecord, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []SessionRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record SessionRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSessionIndexRecordsSession(t *testing.T) {
+	addr := acceptOnce(t, func(c *testConn) {
+		serverLogin(c, testBindFeatures)
+		c.expect(testBindRequest)
+		c.send(testBindResult)
+		c.expect(testStreamEnd)
+		c.send(testStreamEnd)
+	})
+	path := filepath.Join(t.TempDir(), SessionIndexFile)
+	// Without InspectStanzas, the session has to wait for the bind result to learn the JID
+	c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", Hooks: Hooks{Close: []CloseHook{NewSessionIndex(path, nil)}}})
+	clientLogin(c, testBindFeatures)
+	c.send(testBindRequest)
+	c.expect(testBindResult)
+	c.send(testStreamEnd)
+	c.expect(testStreamEnd)
+	c.Close()
+	if err := waitForRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := ReadSessionIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	r := records[0]
+	// The byte-level copy only sees the connections close, and either may close first
+	if r.JID != "a@example.com" || r.Resource != "r" || r.BackendAddr != addr || r.ClosedBy == "" || r.Error != "" {
+		t.Errorf("got %+v", r)
+	}
+	if r.BytesFromClient == 0 || r.BytesFromServer == 0 {
+		t.Errorf("no bytes were counted in %+v", r)
+	}
+}
+
+func TestSessionIndexRecordsConnectFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), SessionIndexFile)
+	addr := closedAddr(t)
+	_, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", Hooks: Hooks{Close: []CloseHook{NewSessionIndex(path, nil)}}})
+	if err := waitForRun(t, done); err == nil {
+		t.Fatal("Run succeeded although the server refused the connection")
+	}
+
+	records, err := ReadSessionIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	if r := records[0]; r.Error == "" || r.CloseReason != r.Error || r.ClosedBy != string(Server) || r.BackendAddr != addr {
+		t.Errorf("got %+v, want the connection error", r)
+	}
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+// ParseInjectedElement checks that raw is a single well-formed XML element and decodes it.
+// Whitespace around the element is dropped, so the XML of the returned element is what gets written.
+// Stream headers and stream ends are rejected since they can't be written in the middle of a session.
+func ParseInjectedElement(raw string) (xmpp.Element, error) {
+	raw = strings.TrimSpace(raw)
+	d := xml.NewDecoder(strings.NewReader(raw))
+	depth, roots := 0, 0
+	for {
+		t, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("xml is not well-formed: %s", err)
+		}
+		switch t1 := t.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				roots++
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 0 && len(strings.TrimSpace(string(t1))) > 0 {
+				return nil, errors.New("xml has text outside of the element")
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, errors.New("xml has unclosed elements")
+	}
+	if roots != 1 {
+		return nil, fmt.Errorf("xml must contain exactly one element but found %d", roots)
+	}
+
+	e, err := xmpp.NewDecoder(strings.NewReader(raw)).NextElement()
+	if err != nil {
+		return nil, err
+	}
+	switch e.(type) {
+	case *xmpp.Stream, xmpp.StreamEnd:
+		return nil, errors.New("stream headers can't be injected")
+	}
+	return e, nil
+}
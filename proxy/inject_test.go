@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+func TestParseInjectedElement(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string // XML of the element, empty if raw should be rejected
+		wantErr string
+	}{
+		{raw: `<message id='x'/>`, want: `<message id='x'/>`},
+		{raw: "  <message id='x'/>\n", want: `<message id='x'/>`},
+		{raw: `<message id='x'/><message id='y'/>`, wantErr: "exactly one element"},
+		{raw: `<message id='x'/>text`, wantErr: "text outside"},
+		{raw: `<message id='x'>`, wantErr: "not well-formed"},
+		{raw: `<message id='x'></iq>`, wantErr: "not well-formed"},
+		{raw: "   ", wantErr: "exactly one element"},
+		{raw: `<stream:stream xmlns:stream='http://etherx.jabber.org/streams'/>`, wantErr: "stream headers"},
+	}
+	for _, test := range tests {
+		e, err := ParseInjectedElement(test.raw)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("ParseInjectedElement(%q) returned error %v, want %q", test.raw, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseInjectedElement(%q) failed: %s", test.raw, err)
+			continue
+		}
+		if e.XML() != test.want || e.Name().Local != "message" {
+			t.Errorf("ParseInjectedElement(%q) = %s %q, want message %q", test.raw, e.Name().Local, e.XML(), test.want)
+		}
+	}
+}
+
+func TestInjectCountsForStreamManagement(t *testing.T) {
+	const (
+		enable   = `<enable xmlns='urn:xmpp:sm:3'/>`
+		enabled  = `<enabled xmlns='urn:xmpp:sm:3' id='inject'/>`
+		injected = `<message id='injected'/>`
+		message  = `<message id='m1'><body>hi</body></message>`
+	)
+	addr := acceptOnce(t, func(c *testConn) {
+		serverLogin(c, `<stream:features/>`)
+		c.expect(enable)
+		c.send(enabled)
+		c.expect(injected)
+		c.expect(message)
+		// The server got both stanzas, but the client only sent one of them
+		c.send(`<a xmlns='urn:xmpp:sm:3' h='2'/>`)
+		c.expect(testStreamEnd)
+		c.send(testStreamEnd)
+	})
+	p, c, done := startTestProxy(t, &Config{Address: addr, Domain: "example.com", InspectStanzas: true})
+	clientLogin(c, `<stream:features/>`)
+	c.send(enable)
+	c.expect(enabled)
+	if err := p.Inject(ClientToServer, "  "+injected+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	c.send(message)
+	ack := c.expect("</a>")
+	if h, _ := xmpp.Attr(decodeElement(t, ack), "h"); h != "1" {
+		t.Errorf("server acknowledgement was rewritten to %s, want 1", h)
+	}
+	c.send(testStreamEnd)
+	c.expect(testStreamEnd)
+	c.Close()
+	waitForRun(t, done)
+}
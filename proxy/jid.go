@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+// jidLogDir is the directory under Config.LogPath that sessions are linked into by their bound JID
+const jidLogDir = "by-jid"
+
+// errBound is returned by the routers once the resource is bound, if that was the last thing to wait for before the byte-level copy
+var errBound = errors.New("resource bound")
+
+// splitJID splits a full JID into its bare JID and resource
+func splitJID(jid string) (bare, resource string) {
+	parts := strings.SplitN(jid, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// jidPathSegment escapes s for use as a single directory name. Resources may contain slashes, and a JID must never be able to name a parent directory.
+func jidPathSegment(s string) string {
+	s = url.PathEscape(s)
+	if s == "" || s == "." || s == ".." {
+		return strings.Replace("_"+s, ".", "%2E", -1)
+	}
+	return s
+}
+
+// JID returns the full JID bound by the client, or an empty string if it hasn't bound a resource yet
+func (p *Proxy) JID() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.jid
+}
+
+// awaitBind returns true if the byte-level copy has to wait until the bound JID is known, so that the session can be filed under it
+// or the hooks that need it learn it
+func (p *Proxy) awaitBind() bool {
+	if p.JID() != "" || p.component {
+		return false
+	}
+	return (p.Config.LogByJID && p.logName != "") || p.Config.Hooks.needJID()
+}
+
+// bindRequestMatcher matches the IQ a client binds its resource with
+var bindRequestMatcher = xmpp.And(xmpp.IQMatcher{}, xmpp.TypeMatcher("set"), xmpp.ChildMatcher{Space: xmpp.NSBind, Local: "bind"})
+
+// bindResponse returns the IQ answering the client's bind request, or nil if e is something else
+func (p *Proxy) bindResponse(e xmpp.Element) *xmpp.IQ {
+	iq, ok := e.(*xmpp.IQ)
+	if !ok || p.bindID == "" || iq.ID != p.bindID || (iq.Type != "result" && iq.Type != "error") {
+		return nil
+	}
+	return iq
+}
+
+// recordBind records the JID the server bound for the client, and files the session under it if Config.LogByJID is set.
+func (p *Proxy) recordBind(jid string) {
+	p.mu.Lock()
+	p.jid = jid
+	p.mu.Unlock()
+	p.bindID = ""
+	p.logger.Infow("resource bound",
+		"jid", jid,
+	)
+	p.resourceBound(jid)
+	if !p.Config.LogByJID || p.logName == "" {
+		return
+	}
+	if err := p.fileByJID(jid); err != nil {
+		p.logger.Warnw("failed to file session logs by JID",
+			"reason", err.Error(),
+		)
+	}
+}
+
+// fileByJID links the session's log files into LogPath/by-jid/<bare JID>/<resource>/ and adds the session to LogPath/by-jid/index.log
+func (p *Proxy) fileByJID(jid string) error {
+	bare, resource := splitJID(jid)
+	dir := filepath.Join(p.Config.LogPath, jidLogDir, jidPathSegment(bare), jidPathSegment(resource))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, logType := range []string{"C2P", "P2S"} {
+		target := fmt.Sprintf("%s.%s.log", p.logName, logType)
+		// Relative links keep working if LogPath is moved or copied somewhere else
+		rel, err := filepath.Rel(dir, target)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(rel, filepath.Join(dir, filepath.Base(target))); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+
+	index, err := os.OpenFile(filepath.Join(p.Config.LogPath, jidLogDir, "index.log"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	// One line per session, so that it can be searched with grep
+	_, err = fmt.Fprintf(index, "%s\t%s\t%s\t%s\t%s\n", p.started.Format(time.RFC3339), p.ID, jid, p.clientAddr, p.logName)
+	return err
+}
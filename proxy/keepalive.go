@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+	"go.uber.org/zap"
+)
+
+// keepaliveCounter tracks the whitespace keepalives travelling in one direction
+type keepaliveCounter struct {
+	count int
+	first time.Time
+	last  time.Time
+}
+
+func (c *keepaliveCounter) seen(now time.Time) {
+	if c.count == 0 {
+		c.first = now
+	}
+	c.count++
+	c.last = now
+}
+
+// interval returns the average time between keepalives, or 0 if there haven't been at least two.
+func (c *keepaliveCounter) interval() time.Duration {
+	if c.count < 2 {
+		return 0
+	}
+	return c.last.Sub(c.first) / time.Duration(c.count-1)
+}
+
+// keepaliveTracker counts the whitespace keepalives sent by each side of a Proxy, so that their frequency is recorded with the session.
+type keepaliveTracker struct {
+	mu     sync.Mutex
+	c2s    keepaliveCounter
+	s2c    keepaliveCounter
+	logger *zap.SugaredLogger
+}
+
+func newKeepaliveTracker(logger *zap.SugaredLogger) *keepaliveTracker {
+	return &keepaliveTracker{logger: logger}
+}
+
+// Seen counts a keepalive travelling in direction.
+func (t *keepaliveTracker) Seen(direction Direction) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if direction == ClientToServer {
+		t.c2s.seen(time.Now())
+	} else {
+		t.s2c.seen(time.Now())
+	}
+}
+
+// countKeepalives is Router middleware that counts the keepalives travelling in direction, whichever Route handles them
+func (p *Proxy) countKeepalives(direction Direction) xmpp.Middleware {
+	return func(next xmpp.Handler) xmpp.Handler {
+		return xmpp.HandlerFunc(func(e xmpp.Element) error {
+			if (xmpp.WhitespaceMatcher{}).Match(e) {
+				p.keepalives.Seen(direction)
+				// Only now is it known that the whitespace the sender's logger held back was a keepalive
+				if direction == ClientToServer {
+					p.client.Logger.MarkKeepalive()
+				} else {
+					p.server.Logger.MarkKeepalive()
+				}
+			}
+			return next.HandleElement(e)
+		})
+	}
+}
+
+// LogSummary logs how many keepalives each side sent and how often.
+func (t *keepaliveTracker) LogSummary() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.c2s.count == 0 && t.s2c.count == 0 {
+		return
+	}
+	t.logger.Infow("keepalive summary",
+		"clientKeepalives", t.c2s.count,
+		"clientKeepaliveInterval", t.c2s.interval().String(),
+		"serverKeepalives", t.s2c.count,
+		"serverKeepaliveInterval", t.s2c.interval().String(),
+	)
+}
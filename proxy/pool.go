@@ -0,0 +1,307 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+	"go.uber.org/zap"
+)
+
+// Policies for picking a backend from a BackendPool
+const (
+	PolicyRoundRobin    string = "round-robin"
+	PolicyLeastSessions string = "least-sessions"
+	PolicyStickyIP      string = "sticky-ip"  // The same client IP always gets the same backend while it's healthy
+	PolicyStickyJID     string = "sticky-jid" // Like sticky-ip, keyed by the from attribute of the client's first stream header if it has one. Most clients only send it after TLS, so sessions usually fall back to sticky-ip.
+)
+
+var errNoHealthyBackends = errors.New("no healthy backends")
+
+// BackendPoolConfig contains config information required for a BackendPool
+type BackendPoolConfig struct {
+	Backends            []string           // host:port of every backend
+	Policy              string             // How a backend is picked for each session. Defaults to round-robin.
+	Domain              string             // Domain that health checks open their stream to
+	HealthCheckInterval int                // Seconds between health checks of each backend. 0 disables them.
+	HealthCheckTimeout  int                // Seconds a health check may take before the backend counts as down
+	UpstreamProxy       string             // SOCKS5 or HTTP CONNECT proxy that health checks connect through. Should match Config.UpstreamProxy.
+	ProxyProtocol       string             // PROXY protocol version that health checks start with. Should match Config.SendProxyProtocol.
+	Logger              *zap.SugaredLogger // Logger used for health changes. A no-op logger is used if nil.
+}
+
+// BackendPool is a set of backends shared by all sessions. Backends that fail a health check are taken out of rotation until they pass one again.
+type BackendPool struct {
+	config   *BackendPoolConfig
+	logger   *zap.SugaredLogger
+	mu       sync.Mutex
+	backends []*backend
+	next     int // Index of the backend that round-robin tries first
+}
+
+type backend struct {
+	address  string
+	healthy  bool
+	sessions int
+}
+
+// NewBackendPool accepts a BackendPoolConfig and returns a new BackendPool with every backend considered healthy
+func NewBackendPool(config *BackendPoolConfig) (*BackendPool, error) {
+	if len(config.Backends) == 0 {
+		return nil, errors.New("backend pool needs at least one backend")
+	}
+	switch config.Policy {
+	case "":
+		config.Policy = PolicyRoundRobin
+	case PolicyRoundRobin, PolicyLeastSessions, PolicyStickyIP, PolicyStickyJID:
+	default:
+		return nil, fmt.Errorf("unknown backend policy %q", config.Policy)
+	}
+	pool := &BackendPool{config: config, logger: config.Logger}
+	if pool.logger == nil {
+		pool.logger = zap.NewNop().Sugar()
+	}
+	for _, addr := range config.Backends {
+		pool.backends = append(pool.backends, &backend{address: addr, healthy: true})
+	}
+	return pool, nil
+}
+
+// stickyJID returns true if picking a backend needs the client's stream header
+func (bp *BackendPool) stickyJID() bool {
+	return bp.config.Policy == PolicyStickyJID
+}
+
+// candidates returns the healthy backends in the order a session with the sticky key should try them
+func (bp *BackendPool) candidates(key string) ([]*backend, error) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	var healthy []*backend
+	for _, b := range bp.backends {
+		if b.healthy {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil, errNoHealthyBackends
+	}
+	switch bp.config.Policy {
+	case PolicyLeastSessions:
+		sort.SliceStable(healthy, func(i, j int) bool { return healthy[i].sessions < healthy[j].sessions })
+	case PolicyStickyIP, PolicyStickyJID:
+		// Rendezvous hashing only moves the keys of a backend that leaves the rotation
+		sort.SliceStable(healthy, func(i, j int) bool { return stickyScore(key, healthy[i]) > stickyScore(key, healthy[j]) })
+	default:
+		start := bp.next % len(healthy)
+		bp.next++
+		healthy = append(healthy[start:], healthy[:start]...)
+	}
+	return healthy, nil
+}
+
+func stickyScore(key string, b *backend) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(b.address))
+	// FNV barely spreads keys that only differ at the end, so the sum is mixed like murmur3's finalizer
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (bp *BackendPool) acquire(b *backend) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	b.sessions++
+}
+
+func (bp *BackendPool) release(b *backend) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	b.sessions--
+}
+
+// setHealthy records the result of a health check or connection attempt, and logs when a backend enters or leaves the rotation
+func (bp *BackendPool) setHealthy(b *backend, healthy bool, reason error) {
+	bp.mu.Lock()
+	changed := b.healthy != healthy
+	b.healthy = healthy
+	bp.mu.Unlock()
+	if !changed {
+		return
+	}
+	if healthy {
+		bp.logger.Infow("backend is healthy again",
+			"backend", b.address,
+		)
+		return
+	}
+	bp.logger.Warnw("backend is unhealthy and out of rotation",
+		"backend", b.address,
+		"reason", reason.Error(),
+	)
+}
+
+// RunHealthChecks checks every backend once per HealthCheckInterval until stop is closed. It returns right away if the interval is 0.
+func (bp *BackendPool) RunHealthChecks(stop <-chan struct{}) {
+	if bp.config.HealthCheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(bp.config.HealthCheckInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, b := range bp.backends {
+			wg.Add(1)
+			go func(b *backend) {
+				defer wg.Done()
+				err := bp.healthCheck(b.address)
+				bp.setHealthy(b, err == nil, err)
+			}(b)
+		}
+		wg.Wait()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// healthCheck opens a stream to addr and expects the server to answer with its stream features
+func (bp *BackendPool) healthCheck(addr string) error {
+	timeout := time.Duration(bp.config.HealthCheckTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	conn, err := dialUpstream(&net.Dialer{Timeout: timeout}, bp.config.UpstreamProxy, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	// Health checks have no client to announce
+	if bp.config.ProxyProtocol != "" {
+		if err := writeProxyProtocolHeader(conn, bp.config.ProxyProtocol, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	header := fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%s' xmlns='%s' xmlns:stream='%s' version='1.0'>", bp.config.Domain, xmpp.NSClient, xmpp.NSStream)
+	if _, err := conn.Write([]byte(header)); err != nil {
+		return err
+	}
+	d := xmpp.NewDecoder(conn)
+	for {
+		e, err := d.NextElement()
+		if err != nil {
+			return err
+		}
+		switch e.(type) {
+		case *xmpp.Stream, xmpp.Whitespace:
+			continue
+		}
+		if e.Name().Space == xmpp.NSStream && e.Name().Local == "features" {
+			conn.Write([]byte("</stream:stream>"))
+			return nil
+		}
+		return fmt.Errorf("expected stream features but got %s", e.Name().Local)
+	}
+}
+
+// stickyKey returns the key that sticky policies pick a backend with for the client at clientAddr.
+// The bare JID from the stream header is used with sticky-jid, and the client IP otherwise.
+func (bp *BackendPool) stickyKey(clientAddr net.Addr, stream *xmpp.Stream) string {
+	if bp.config.Policy == PolicyStickyJID && stream != nil && stream.From != "" {
+		return strings.SplitN(stream.From, "/", 2)[0]
+	}
+	host, _, err := net.SplitHostPort(clientAddr.String())
+	if err != nil {
+		return clientAddr.String()
+	}
+	return host
+}
+
+// connectFailed takes a backend that refused a session out of rotation until its next successful health check.
+// Without health checks it would never come back, so it stays in rotation then.
+func (bp *BackendPool) connectFailed(b *backend, err error) {
+	if bp.config.HealthCheckInterval > 0 {
+		bp.setHealthy(b, false, err)
+	}
+}
+
+// connectPool connects to the first backend picked by the pool's policy that accepts the connection within timeout.
+func (p *Proxy) connectPool(timeout time.Duration) error {
+	pool := p.Config.Backends
+	var stream *xmpp.Stream
+	if pool.stickyJID() {
+		var err error
+		if stream, err = p.awaitClientStream(); err != nil {
+			return err
+		}
+	}
+	if pool.stickyJID() && stream.From == "" {
+		// The backend has to be picked before the client authenticates, so its JID is only known if it announced it
+		p.logger.Infow("client stream header has no from attribute, picking the backend by client IP",
+			"policy", pool.config.Policy,
+		)
+	}
+	candidates, err := pool.candidates(pool.stickyKey(p.clientAddr, stream))
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for _, b := range candidates {
+		conn, err := p.dialServer(&net.Dialer{Deadline: deadline}, b.address)
+		if err != nil {
+			p.logger.Warnw("failed to connect to backend",
+				"backend", b.address,
+				"reason", err.Error(),
+			)
+			pool.connectFailed(b, err)
+			lastErr = err
+			continue
+		}
+		pool.acquire(b)
+		p.backend = b
+		p.serverAddr = b.address
+		p.setLogger(p.logger.With("backend", b.address))
+		p.logger.Infow("connected to backend",
+			"policy", pool.config.Policy,
+		)
+		return p.SetServerConn(conn)
+	}
+	return fmt.Errorf("no backend could be reached: %s", lastErr)
+}
+
+// awaitClientStream reads the client's stream header before a backend is picked. It's routed as usual once the routers run.
+func (p *Proxy) awaitClientStream() (*xmpp.Stream, error) {
+	for {
+		e, err := p.client.Decoder.NextElement()
+		if err != nil {
+			p.handleDecoderError(ClientToServer, err)
+			return nil, err
+		}
+		// Whitespace in front of the stream header has nowhere to go yet
+		if stream, ok := e.(*xmpp.Stream); ok {
+			p.pendingStream = stream
+			return stream, nil
+		}
+		if _, ok := e.(xmpp.Whitespace); !ok {
+			return nil, fmt.Errorf("expected xmpp.Stream but got something else: %s", e.XML())
+		}
+	}
+}
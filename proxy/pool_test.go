@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// newTestPool returns a pool of n backends named b0:5222, b1:5222 and so on
+func newTestPool(t *testing.T, policy string, n int) *BackendPool {
+	t.Helper()
+	var backends []string
+	for i := 0; i < n; i++ {
+		backends = append(backends, fmt.Sprintf("b%d:5222", i))
+	}
+	pool, err := NewBackendPool(&BackendPoolConfig{Backends: backends, Policy: policy})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+// candidateAddrs returns the addresses of the candidates for key in the order they are tried
+func candidateAddrs(t *testing.T, pool *BackendPool, key string) []string {
+	t.Helper()
+	candidates, err := pool.candidates(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, b := range candidates {
+		addrs = append(addrs, b.address)
+	}
+	return addrs
+}
+
+func TestBackendPoolPolicies(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		sessions  []int      // Running sessions of each backend
+		unhealthy []int      // Indexes of the backends out of rotation
+		want      [][]string // Candidates of consecutive sessions
+	}{
+		{
+			name:   "round-robin",
+			policy: PolicyRoundRobin,
+			want:   [][]string{{"b0:5222", "b1:5222", "b2:5222"}, {"b1:5222", "b2:5222", "b0:5222"}, {"b2:5222", "b0:5222", "b1:5222"}},
+		},
+		{
+			name:   "default policy",
+			policy: "",
+			want:   [][]string{{"b0:5222", "b1:5222", "b2:5222"}, {"b1:5222", "b2:5222", "b0:5222"}},
+		},
+		{
+			name:      "round-robin skips unhealthy",
+			policy:    PolicyRoundRobin,
+			unhealthy: []int{1},
+			want:      [][]string{{"b0:5222", "b2:5222"}, {"b2:5222", "b0:5222"}, {"b0:5222", "b2:5222"}},
+		},
+		{
+			name:     "least-sessions",
+			policy:   PolicyLeastSessions,
+			sessions: []int{2, 0, 1},
+			want:     [][]string{{"b1:5222", "b2:5222", "b0:5222"}, {"b1:5222", "b2:5222", "b0:5222"}},
+		},
+		{
+			name:     "least-sessions keeps the configured order of ties",
+			policy:   PolicyLeastSessions,
+			sessions: []int{1, 0, 0},
+			want:     [][]string{{"b1:5222", "b2:5222", "b0:5222"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestPool(t, test.policy, 3)
+			for i, n := range test.sessions {
+				pool.backends[i].sessions = n
+			}
+			for _, i := range test.unhealthy {
+				pool.backends[i].healthy = false
+			}
+			for i, want := range test.want {
+				if got := candidateAddrs(t, pool, ""); !reflect.DeepEqual(got, want) {
+					t.Errorf("session %d got candidates %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBackendPoolNoHealthyBackends(t *testing.T) {
+	pool := newTestPool(t, PolicyRoundRobin, 2)
+	for _, b := range pool.backends {
+		b.healthy = false
+	}
+	if _, err := pool.candidates(""); err != errNoHealthyBackends {
+		t.Errorf("got %v, want errNoHealthyBackends", err)
+	}
+}
+
+func TestBackendPoolRejectsUnknownPolicy(t *testing.T) {
+	if _, err := NewBackendPool(&BackendPoolConfig{Backends: []string{"b0:5222"}, Policy: "random"}); err == nil {
+		t.Error("unknown policy was accepted")
+	}
+	if _, err := NewBackendPool(&BackendPoolConfig{Policy: PolicyRoundRobin}); err == nil {
+		t.Error("pool without backends was accepted")
+	}
+}
+
+func TestBackendPoolSticky(t *testing.T) {
+	for _, policy := range []string{PolicyStickyIP, PolicyStickyJID} {
+		t.Run(policy, func(t *testing.T) {
+			pool := newTestPool(t, policy, 4)
+			firsts := map[string]int{}
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("10.0.0.%d", i)
+				order := candidateAddrs(t, pool, key)
+				if again := candidateAddrs(t, pool, key); !reflect.DeepEqual(order, again) {
+					t.Fatalf("key %s got candidates %v, then %v", key, order, again)
+				}
+				firsts[order[0]]++
+
+				// Rendezvous hashing: taking a backend out of rotation only moves the keys it served, to their next candidate
+				for j, b := range pool.backends {
+					if b.address != order[len(order)-1] {
+						continue
+					}
+					b.healthy = false
+					if got := candidateAddrs(t, pool, key); !reflect.DeepEqual(got, order[:len(order)-1]) {
+						t.Errorf("key %s got candidates %v without backend %d, want %v", key, got, j, order[:len(order)-1])
+					}
+					b.healthy = true
+				}
+				pool.backends[indexOf(pool, order[0])].healthy = false
+				if got := candidateAddrs(t, pool, key); !reflect.DeepEqual(got, order[1:]) {
+					t.Errorf("key %s got candidates %v without its first backend, want %v", key, got, order[1:])
+				}
+				pool.backends[indexOf(pool, order[0])].healthy = true
+			}
+			for _, b := range pool.backends {
+				if firsts[b.address] < 10 {
+					t.Errorf("backend %s was first for %d of 100 keys", b.address, firsts[b.address])
+				}
+			}
+		})
+	}
+}
+
+func indexOf(pool *BackendPool, addr string) int {
+	for i, b := range pool.backends {
+		if b.address == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestBackendPoolStickyKey(t *testing.T) {
+	v4 := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+	tests := []struct {
+		name   string
+		policy string
+		addr   net.Addr
+		from   string
+		want   string
+	}{
+		{name: "sticky-ip", policy: PolicyStickyIP, addr: v4, want: "192.0.2.1"},
+		{name: "sticky-ip ipv6", policy: PolicyStickyIP, addr: v6, want: "2001:db8::1"},
+		{name: "sticky-ip ignores from", policy: PolicyStickyIP, addr: v4, from: "a@example.com", want: "192.0.2.1"},
+		{name: "sticky-jid", policy: PolicyStickyJID, addr: v4, from: "a@example.com/r", want: "a@example.com"},
+		{name: "sticky-jid without from", policy: PolicyStickyJID, addr: v4, want: "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestPool(t, test.policy, 1)
+			stream := &xmpp.Stream{From: test.from}
+			if got := pool.stickyKey(test.addr, stream); got != test.want {
+				t.Errorf("got key %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestBackendPoolHealthCheck(t *testing.T) {
+	healthy := acceptOnce(t, func(c *testConn) {
+		c.expect("version='1.0'>")
+		c.send(testServerHeader + testMechanisms)
+		c.expect(testStreamEnd)
+	})
+	broken := acceptOnce(t, func(c *testConn) {
+		c.expect("version='1.0'>")
+		c.send(testServerHeader + `<iq type='get' id='1'/>`)
+	})
+	down := closedAddr(t)
+
+	pool, err := NewBackendPool(&BackendPoolConfig{
+		Backends:            []string{healthy, broken, down},
+		Domain:              "example.com",
+		HealthCheckInterval: 1,
+		HealthCheckTimeout:  int(testTimeout.Seconds()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A closed stop channel ends the checks after the first round
+	stop := make(chan struct{})
+	close(stop)
+	pool.RunHealthChecks(stop)
+	if got, want := candidateAddrs(t, pool, ""), []string{healthy}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got candidates %v after the health checks, want %v", got, want)
+	}
+}
+
+func TestBackendPoolConnectFailover(t *testing.T) {
+	addr := acceptOnce(t, func(c *testConn) {
+		serverLogin(c, `<stream:features/>`)
+		c.expect(" ")
+		c.expect(testStreamEnd)
+		c.send(testStreamEnd)
+	})
+	down := closedAddr(t)
+	pool, err := NewBackendPool(&BackendPoolConfig{Backends: []string{down, addr}, HealthCheckInterval: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, logs := observer.New(zap.InfoLevel)
+	c, done := runTestProxy(t, &Config{Domain: "example.com", InspectStanzas: true, Backends: pool, Logger: zap.New(core).Sugar()})
+	clientLogin(c, `<stream:features/>`)
+	c.send(" ")
+	c.send(testStreamEnd)
+	c.expect(testStreamEnd)
+	c.Close()
+	if err := waitForRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backend that refused the session is out of rotation until a health check passes
+	if got, want := candidateAddrs(t, pool, ""), []string{addr}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got candidates %v, want %v", got, want)
+	}
+	// The summaries logged when the session ends name the backend like everything else
+	summaries := logs.FilterMessage("keepalive summary").All()
+	if len(summaries) != 1 {
+		t.Fatalf("got %d keepalive summaries, want 1", len(summaries))
+	}
+	if backend := summaries[0].ContextMap()["backend"]; backend != addr {
+		t.Errorf("keepalive summary names backend %v, want %s", backend, addr)
+	}
+}
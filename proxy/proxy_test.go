@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+// Stream headers and SASL elements of the scripted sessions in the tests
+const (
+	testClientHeader = `<stream:stream to='example.com' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>`
+	testServerHeader = `<?xml version='1.0'?><stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' from='example.com' id='s1' version='1.0'>`
+	testMechanisms   = `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`
+	testAuth         = `<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>AGEAYg==</auth>`
+	testSuccess      = `<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>`
+	testStreamEnd    = `</stream:stream>`
+	testBindFeatures = `<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`
+	testBindRequest  = `<iq type='set' id='b1'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></iq>`
+	testBindResult   = `<iq type='result' id='b1'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>a@example.com/r</jid></bind></iq>`
+)
+
+// testTimeout bounds every wait of the tests, so that a broken session fails the test instead of hanging it
+const testTimeout = 5 * time.Second
+
+// testConn is one end of a scripted session
+type testConn struct {
+	net.Conn
+	t *testing.T
+	r *bufio.Reader
+}
+
+func newTestConn(t *testing.T, conn net.Conn) *testConn {
+	return &testConn{Conn: conn, t: t, r: bufio.NewReader(conn)}
+}
+
+func (c *testConn) send(s string) {
+	if _, err := c.Write([]byte(s)); err != nil {
+		c.t.Errorf("failed to send %q: %s", s, err)
+	}
+}
+
+// expect reads until s has been read, and returns everything that was read
+func (c *testConn) expect(s string) string {
+	c.SetReadDeadline(time.Now().Add(testTimeout))
+	var sb strings.Builder
+	for !strings.HasSuffix(sb.String(), s) {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			c.t.Errorf("expected %q but got %q: %s", s, sb.String(), err)
+			return sb.String()
+		}
+		sb.WriteByte(b)
+	}
+	return sb.String()
+}
+
+// readAll reads until the connection is closed, and returns everything that was read
+func (c *testConn) readAll() string {
+	c.SetReadDeadline(time.Now().Add(testTimeout))
+	var sb strings.Builder
+	for {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return sb.String()
+		}
+		sb.WriteByte(b)
+	}
+}
+
+// acceptOnce listens on a local port and runs handle with the first connection in the background. The connection is closed once handle returns.
+func acceptOnce(t *testing.T, handle func(c *testConn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(newTestConn(t, conn))
+	}()
+	return l.Addr().String()
+}
+
+// closedAddr returns a local address that refuses connections
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+// serverLogin plays a server up to the stream features after SASL success, which are sent as features
+func serverLogin(c *testConn, features string) {
+	c.expect("version='1.0'>")
+	c.send(testServerHeader + testMechanisms)
+	c.expect("</auth>")
+	c.send(testSuccess)
+	c.expect("version='1.0'>")
+	c.send(testServerHeader + features)
+}
+
+// clientLogin plays a client up to the stream features after SASL success, which are expected to end with features
+func clientLogin(c *testConn, features string) {
+	c.send(testClientHeader)
+	c.expect("</stream:features>")
+	c.send(testAuth)
+	c.expect(testSuccess)
+	c.send(testClientHeader)
+	c.expect(features)
+}
+
+// runTestProxy runs a session of config in the background and returns the client's end of it. The result of Run is sent on the
+// returned channel.
+func runTestProxy(t *testing.T, config *Config) (*testConn, <-chan error) {
+	_, c, done := startTestProxy(t, config)
+	return c, done
+}
+
+// startTestProxy is runTestProxy for tests that also need the running Proxy.
+func startTestProxy(t *testing.T, config *Config) (*Proxy, *testConn, <-chan error) {
+	client, proxyEnd := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	done := make(chan error, 1)
+	p, err := New(proxyEnd, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { done <- p.Run() }()
+	return p, newTestConn(t, client), done
+}
+
+// waitForRun fails the test if the session doesn't end in time
+func waitForRun(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(testTimeout):
+		t.Fatal("session didn't end")
+		return nil
+	}
+}
+
+// newTestProxy returns a Proxy whose client is one end of a pipe, for testing parts of a session without running it
+func newTestProxy(t *testing.T, config *Config) *Proxy {
+	client, proxyEnd := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		proxyEnd.Close()
+	})
+	p, err := New(proxyEnd, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSession(t *testing.T) {
+	message := `<message to='b@example.com' id='m1'><body>hi</body></message>`
+	reply := `<message from='b@example.com' id='m2'><body>hello</body></message>`
+	var serverGot string
+	addr := acceptOnce(t, func(c *testConn) {
+		serverLogin(c, `<stream:features/>`)
+		serverGot = c.expect(message)
+		c.send(reply)
+		c.expect(testStreamEnd)
+		c.send(testStreamEnd)
+	})
+
+	c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com"})
+	clientLogin(c, `<stream:features/>`)
+	c.send(message)
+	c.expect(reply)
+	c.send(testStreamEnd)
+	c.expect(testStreamEnd)
+	c.Close()
+	waitForRun(t, done)
+	if serverGot != message {
+		t.Errorf("server got %q, want %q", serverGot, message)
+	}
+}
+
+func TestNewFailsWithoutLogs(t *testing.T) {
+	// A file where the log directory should be keeps the session's logs from being opened
+	logPath := filepath.Join(t.TempDir(), "logs")
+	if err := ioutil.WriteFile(logPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	client, proxyEnd := net.Pipe()
+	defer client.Close()
+	defer proxyEnd.Close()
+	if p, err := New(proxyEnd, nil, &Config{Address: closedAddr(t), LogPath: logPath}); err == nil {
+		t.Errorf("New returned %v although the logs can't be opened", p)
+	}
+}
+
+func TestPassthroughForwardsOnce(t *testing.T) {
+	message := `<message from='b@example.com' id='m1'><body>hi</body></message>`
+	tests := []struct {
+		name   string
+		config Config
+		bind   bool
+	}{
+		// The message arrives in the same read as the stream features following SASL success
+		{name: "after stream features"},
+		// The message arrives in the same read as the bind result, which the copy waits for to file the session under the JID
+		{name: "after bind result", config: Config{LogByJID: true}, bind: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := acceptOnce(t, func(c *testConn) {
+				if !test.bind {
+					serverLogin(c, `<stream:features/>`+message+testStreamEnd)
+					return
+				}
+				serverLogin(c, testBindFeatures)
+				c.expect(testBindRequest)
+				c.send(testBindResult + message + testStreamEnd)
+			})
+
+			config := test.config
+			config.Address, config.Domain = addr, "example.com"
+			// The client's side is copied byte by byte, so the end of its stream isn't noticed and the session ends with the timeout
+			config.CloseTimeout = 1
+			if test.bind {
+				config.LogPath = t.TempDir()
+			}
+			c, done := runTestProxy(t, &config)
+			if !test.bind {
+				clientLogin(c, `<stream:features/>`)
+			} else {
+				clientLogin(c, testBindFeatures)
+				c.send(testBindRequest)
+			}
+			got := c.expect(testStreamEnd)
+			// Anything forwarded again would be read before the session ends and the pipe closes
+			c.send(testStreamEnd)
+			got += c.readAll()
+			c.Close()
+			waitForRun(t, done)
+			if n := strings.Count(got, message); n != 1 {
+				t.Errorf("message was forwarded %d times in %q", n, got)
+			}
+			if !strings.HasSuffix(got, testStreamEnd) {
+				t.Errorf("got %q, want it to end with the stream", got)
+			}
+		})
+	}
+}
+
+func TestDecoderLimitPolicyViolation(t *testing.T) {
+	deep := `<message><a xmlns='urn:example'><b><c/></b></a></message>`
+	policyViolation := `<stream:error><policy-violation xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>`
+	for _, direction := range []Direction{ClientToServer, ServerToClient} {
+		direction := direction
+		t.Run(string(direction), func(t *testing.T) {
+			addr := acceptOnce(t, func(c *testConn) {
+				serverLogin(c, `<stream:features/>`)
+				if direction == ServerToClient {
+					c.send(deep)
+					c.expect(policyViolation)
+				}
+				c.readAll()
+			})
+			c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", InspectStanzas: true, Limits: xmpp.Limits{MaxDepth: 3}})
+			clientLogin(c, `<stream:features/>`)
+			if direction == ClientToServer {
+				c.send(deep)
+				c.expect(policyViolation)
+			}
+			got := c.readAll()
+			if direction == ServerToClient && strings.Contains(got, "<message>") {
+				t.Errorf("client got the element over the limit: %s", got)
+			}
+			c.Close()
+			waitForRun(t, done)
+		})
+	}
+}
+
+func TestPrettifyAddress(t *testing.T) {
+	pipe, _ := net.Pipe()
+	defer pipe.Close()
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{addr: &net.TCPAddr{IP: net.ParseIP("172.30.127.184"), Port: 56690}, want: "172-30-127-184"},
+		{addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56690}, want: "2001-db8--1"},
+		{addr: &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 5222, Zone: "eth0"}, want: "fe80--1_eth0"},
+		{addr: &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 5222}, want: "192-0-2-1"},
+		{addr: pipe.RemoteAddr(), want: "pipe"},
+	}
+	for _, test := range tests {
+		if got := prettifyAddress(test.addr); got != test.want {
+			t.Errorf("prettifyAddress(%s) = %q, want %q", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestLogNameIPv6(t *testing.T) {
+	_, conn := tcpPair(t, "tcp", "[::1]:0")
+	logPath := t.TempDir()
+	p, err := New(conn, nil, &Config{Address: "example.com:5222", Domain: "example.com", LogPath: logPath, FileTimeFormat: "2006-01-02_15-04-05"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir := filepath.Dir(p.LogName()); dir != filepath.Join(logPath, "--1") {
+		t.Errorf("logged to %s, want a directory named after ::1", dir)
+	}
+}
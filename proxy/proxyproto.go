@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Versions of the HAProxy PROXY protocol
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+const (
+	ProxyProtocolV1 string = "v1"
+	ProxyProtocolV2 string = "v2"
+)
+
+const proxyProtocolV1MaxLength = 107
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ValidateProxyProtocol returns an error if version isn't empty or one of the supported versions
+func ValidateProxyProtocol(version string) error {
+	switch version {
+	case "", ProxyProtocolV1, ProxyProtocolV2:
+		return nil
+	}
+	return fmt.Errorf("unknown PROXY protocol version %q", version)
+}
+
+// proxyProtocolConn is a connection that started with a PROXY protocol header. RemoteAddr returns the client address from the header.
+type proxyProtocolConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// CloseWrite half-closes the connection underneath, so that closing streams works as it does without the header
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// SyscallConn exposes the socket underneath, which transparent mode reads the original destination from
+func (c *proxyProtocolConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, fmt.Errorf("can't access the socket of a %T", c.Conn)
+}
+
+// ReadProxyProtocolHeader reads a PROXY protocol v1 or v2 header from the start of conn, which has to arrive within timeout.
+// The returned connection reports the client address from the header as its RemoteAddr, unless the header says that the
+// connection was made by the load balancer itself e.g. for a health check.
+func ReadProxyProtocolHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	r := bufio.NewReader(conn)
+	sig, err := r.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %s", err)
+	}
+	var src net.Addr
+	switch {
+	case bytes.Equal(sig, proxyProtocolV2Signature):
+		src, err = readProxyProtocolV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		src, err = readProxyProtocolV1(r)
+	default:
+		err = errors.New("connection didn't start with a PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if src == nil {
+		src = conn.RemoteAddr()
+	}
+	return &proxyProtocolConn{Conn: conn, r: r, remoteAddr: src}, nil
+}
+
+// readProxyProtocolV1 reads a header like "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5222\r\n"
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY protocol v1 header: %s", err)
+		}
+		line = append(line, b)
+		if len(line) > proxyProtocolV1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header is too long")
+		}
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyProtocolV2 reads a binary header. Only the addresses of TCP over IPv4 and IPv6 are used, and TLVs are skipped.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol v2 header: %s", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 version %d", header[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol v2 addresses: %s", err)
+	}
+	// LOCAL connections come from the load balancer itself
+	switch header[12] & 0x0f {
+	case 0:
+		return nil, nil
+	case 1:
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol v2 command %d", header[12]&0x0f)
+	}
+	switch header[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("PROXY protocol v2 IPv4 addresses are too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("PROXY protocol v2 IPv6 addresses are too short")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	// UDP, unix sockets and unspecified families keep the address of the connection
+	return nil, nil
+}
+
+// proxyProtocolIPv6 formats ip for a TCP6 header. net.IP prints IPv4 addresses mapped into IPv6 like plain IPv4 addresses, which
+// a TCP6 header must not contain.
+func proxyProtocolIPv6(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return "::ffff:" + v4.String()
+	}
+	return ip.String()
+}
+
+// writeProxyProtocolHeader writes a header of version announcing a connection from src to dst.
+// If either isn't a TCP address, the header announces a connection without addresses, which servers treat as coming from the proxy itself.
+func writeProxyProtocolHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcTCP, ok1 := src.(*net.TCPAddr)
+	dstTCP, ok2 := dst.(*net.TCPAddr)
+	known := ok1 && ok2
+	// Both addresses have to be of the same family, so IPv4 is mapped into IPv6 if the other one is IPv6
+	ipv4 := known && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+
+	var header []byte
+	switch version {
+	case ProxyProtocolV1:
+		switch {
+		case !known:
+			header = []byte("PROXY UNKNOWN\r\n")
+		case ipv4:
+			header = []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", srcTCP.IP.To4(), dstTCP.IP.To4(), srcTCP.Port, dstTCP.Port))
+		default:
+			header = []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", proxyProtocolIPv6(srcTCP.IP), proxyProtocolIPv6(dstTCP.IP), srcTCP.Port, dstTCP.Port))
+		}
+	case ProxyProtocolV2:
+		header = append(header, proxyProtocolV2Signature...)
+		var addrs []byte
+		switch {
+		case !known:
+			// LOCAL command, unspecified family
+			header = append(header, 0x20, 0x00)
+		case ipv4:
+			header = append(header, 0x21, 0x11)
+			addrs = append(append(addrs, srcTCP.IP.To4()...), dstTCP.IP.To4()...)
+		default:
+			header = append(header, 0x21, 0x21)
+			addrs = append(append(addrs, srcTCP.IP.To16()...), dstTCP.IP.To16()...)
+		}
+		if known {
+			addrs = append(addrs, byte(srcTCP.Port>>8), byte(srcTCP.Port), byte(dstTCP.Port>>8), byte(dstTCP.Port))
+		}
+		header = append(header, byte(len(addrs)>>8), byte(len(addrs)))
+		header = append(header, addrs...)
+	default:
+		return ValidateProxyProtocol(version)
+	}
+	_, err := w.Write(header)
+	return err
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// readTestProxyProtocolHeader passes raw, followed by a stream header, through ReadProxyProtocolHeader. It returns the remote address
+// of the connection, or the error, and checks that the stream header is left to be read.
+func readTestProxyProtocolHeader(t *testing.T, raw []byte) (net.Addr, error) {
+	t.Helper()
+	client, proxyEnd := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		proxyEnd.Close()
+	})
+	go client.Write(append(append([]byte(nil), raw...), testClientHeader...))
+	conn, err := ReadProxyProtocolHeader(proxyEnd, testTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rest := make([]byte, len(testClientHeader))
+	if _, err := io.ReadFull(conn, rest); err != nil || string(rest) != testClientHeader {
+		t.Errorf("read %q after the header, want the stream header: %v", rest, err)
+	}
+	return conn.RemoteAddr(), nil
+}
+
+// v2Header returns a PROXY protocol v2 header with the version and command byte vc, the family byte and body
+func v2Header(vc, family byte, body string) []byte {
+	b, err := hex.DecodeString(strings.Replace(body, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	header := append(append([]byte(nil), proxyProtocolV2Signature...), vc, family, byte(len(b)>>8), byte(len(b)))
+	return append(header, b...)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	const (
+		v4Addrs = "c0000201 c6336401 dc04 1466"                                                 // 192.0.2.1:56324 -> 198.51.100.1:5222
+		v6Addrs = "20010db8000000000000000000000001 20010db8000000000000000000000002 dc04 1466" // [2001:db8::1]:56324 -> [2001:db8::2]:5222
+	)
+	tests := []struct {
+		name    string
+		raw     []byte
+		want    string // Remote address of the returned connection. "pipe" is the address of the connection itself.
+		wantErr bool
+	}{
+		{name: "v1 TCP4", raw: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 5222\r\n"), want: "192.0.2.1:56324"},
+		{name: "v1 TCP6", raw: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 5222\r\n"), want: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", raw: []byte("PROXY UNKNOWN\r\n"), want: "pipe"},
+		{name: "v1 UNKNOWN with addresses", raw: []byte("PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 5222\r\n"), want: "pipe"},
+		{name: "v1 longest header", raw: []byte("PROXY UNKNOWN ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"), want: "pipe"},
+		{name: "v1 too long", raw: []byte("PROXY UNKNOWN ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 655350 65535\r\n"), wantErr: true},
+		{name: "v1 unknown protocol", raw: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 5222\r\n"), wantErr: true},
+		{name: "v1 missing port", raw: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), wantErr: true},
+		{name: "v1 bad address", raw: []byte("PROXY TCP4 192.0.2 198.51.100.1 56324 5222\r\n"), wantErr: true},
+		{name: "v1 bad port", raw: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 5222\r\n"), wantErr: true},
+		{name: "v2 TCP4", raw: v2Header(0x21, 0x11, v4Addrs), want: "192.0.2.1:56324"},
+		{name: "v2 TCP4 with TLVs", raw: v2Header(0x21, 0x11, v4Addrs+"01 0005 786d7070 32"+"04 0000"), want: "192.0.2.1:56324"},
+		{name: "v2 TCP6", raw: v2Header(0x21, 0x21, v6Addrs), want: "[2001:db8::1]:56324"},
+		{name: "v2 TCP6 with TLVs", raw: v2Header(0x21, 0x21, v6Addrs+"02 0009 6578616d706c652e636f"), want: "[2001:db8::1]:56324"},
+		{name: "v2 LOCAL", raw: v2Header(0x20, 0x00, ""), want: "pipe"},
+		{name: "v2 LOCAL with addresses", raw: v2Header(0x20, 0x11, v4Addrs), want: "pipe"},
+		{name: "v2 UDP4", raw: v2Header(0x21, 0x12, v4Addrs), want: "pipe"},
+		{name: "v2 TCP4 too short", raw: v2Header(0x21, 0x11, "c0000201 c6336401"), wantErr: true},
+		{name: "v2 TCP6 too short", raw: v2Header(0x21, 0x21, "20010db8000000000000000000000001"), wantErr: true},
+		{name: "v2 unknown version", raw: v2Header(0x31, 0x11, v4Addrs), wantErr: true},
+		{name: "v2 unknown command", raw: v2Header(0x22, 0x11, v4Addrs), wantErr: true},
+		{name: "no header", raw: []byte(testClientHeader), wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, err := readTestProxyProtocolHeader(t, test.raw)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("got address %v, want an error", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if addr.String() != test.want {
+				t.Errorf("got address %s, want %s", addr, test.want)
+			}
+		})
+	}
+}
+
+func TestReadProxyProtocolHeaderTruncated(t *testing.T) {
+	// The header is cut off by the connection closing, which must fail instead of hanging
+	for _, raw := range [][]byte{
+		[]byte("PROXY TCP4 192.0.2.1"),
+		v2Header(0x21, 0x11, "c0000201 c6336401 dc04 1466")[:20],
+	} {
+		client, proxyEnd := net.Pipe()
+		go func() {
+			client.Write(raw)
+			client.Close()
+		}()
+		if _, err := ReadProxyProtocolHeader(proxyEnd, testTimeout); err == nil {
+			t.Errorf("truncated header %q was accepted", raw)
+		}
+		proxyEnd.Close()
+	}
+}
+
+func TestWriteProxyProtocolHeader(t *testing.T) {
+	v4Src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324}
+	v4Dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5222}
+	v6Src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	v6Dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 5222}
+	tests := []struct {
+		name     string
+		src, dst net.Addr
+		wantV1   string
+		wantAddr string // The client address a reader of the header gets, "pipe" if it keeps the address of the connection
+	}{
+		{name: "ipv4", src: v4Src, dst: v4Dst, wantV1: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 5222\r\n", wantAddr: "192.0.2.1:56324"},
+		{name: "ipv6", src: v6Src, dst: v6Dst, wantV1: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 5222\r\n", wantAddr: "[2001:db8::1]:56324"},
+		{name: "ipv4 client of ipv6 listener", src: v4Src, dst: v6Dst, wantV1: "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 5222\r\n", wantAddr: "192.0.2.1:56324"},
+		{name: "unknown", src: &net.UnixAddr{Name: "/tmp/s", Net: "unix"}, dst: v4Dst, wantV1: "PROXY UNKNOWN\r\n", wantAddr: "pipe"},
+		{name: "no client", dst: v4Dst, wantV1: "PROXY UNKNOWN\r\n", wantAddr: "pipe"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, version := range []string{ProxyProtocolV1, ProxyProtocolV2} {
+				var header bytes.Buffer
+				if err := writeProxyProtocolHeader(&header, version, test.src, test.dst); err != nil {
+					t.Fatal(err)
+				}
+				if version == ProxyProtocolV1 && header.String() != test.wantV1 {
+					t.Errorf("wrote %q, want %q", header.String(), test.wantV1)
+				}
+				addr, err := readTestProxyProtocolHeader(t, header.Bytes())
+				if err != nil {
+					t.Fatalf("%s header %q can't be read: %s", version, header.Bytes(), err)
+				}
+				if got := addr.String(); got != test.wantAddr {
+					t.Errorf("%s header announces %s, want %s", version, got, test.wantAddr)
+				}
+			}
+		})
+	}
+	if err := writeProxyProtocolHeader(&bytes.Buffer{}, "v3", v4Src, v4Dst); err == nil {
+		t.Error("unknown version was written")
+	}
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+// isChannelBinding returns true for SASL mechanisms that bind authentication to the TLS channel, e.g. SCRAM-SHA-1-PLUS.
+// Since the proxy terminates TLS separately on both legs, these mechanisms can never succeed through it.
+func isChannelBinding(mechanism string) bool {
+	return strings.HasSuffix(strings.ToUpper(mechanism), "-PLUS")
+}
+
+// allowMechanism returns true if mechanism may be offered to the client
+func (c *Config) allowMechanism(mechanism string) bool {
+	if c.StripChannelBinding && isChannelBinding(mechanism) {
+		return false
+	}
+	if len(c.SASLMechanisms) == 0 {
+		return true
+	}
+	for _, m := range c.SASLMechanisms {
+		if strings.EqualFold(m, mechanism) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterMechanisms removes the SASL mechanisms that aren't allowed by the config from the stream features in e.
+func (p *Proxy) filterMechanisms(e xmpp.Element) (xmpp.Element, error) {
+	mechanisms := xmpp.Mechanisms(e)
+	if len(mechanisms) == 0 {
+		return e, nil
+	}
+	var kept, removed []string
+	p.serverOffersCB = false
+	for _, m := range mechanisms {
+		p.serverOffersCB = p.serverOffersCB || isChannelBinding(m)
+		if p.Config.allowMechanism(m) {
+			kept = append(kept, m)
+		} else {
+			removed = append(removed, m)
+		}
+	}
+	if len(removed) == 0 {
+		return e, nil
+	}
+	if len(kept) == 0 {
+		p.logger.Warnw("no SASL mechanisms left to offer the client",
+			"removed", removed,
+		)
+	} else {
+		p.logger.Infow("removed SASL mechanisms from stream features",
+			"removed", removed,
+			"offered", kept,
+		)
+	}
+	e, err := xmpp.WithMechanisms(e, kept)
+	if err != nil {
+		return nil, err
+	}
+	if p.Config.StripChannelBinding {
+		// Channel binding types advertised by XEP-0440 are meaningless without the -PLUS mechanisms
+		return xmpp.WithoutChildren(e, func(name xml.Name) bool {
+			return name.Space == xmpp.NSSASLCB
+		})
+	}
+	return e, nil
+}
+
+// recordSASLAuth remembers the mechanism chosen by the client in an <auth/> element so that a later failure can be explained.
+func (p *Proxy) recordSASLAuth(e xmpp.Element) {
+	p.saslMechanism, _ = xmpp.Attr(e, "mechanism")
+	p.saslCBDowngrade = false
+	if isChannelBinding(p.saslMechanism) {
+		p.logger.Warnw("client chose a channel binding SASL mechanism which can't succeed through the proxy. set StripChannelBinding to hide these mechanisms",
+			"mechanism", p.saslMechanism,
+		)
+		return
+	}
+	if strings.HasPrefix(strings.ToUpper(p.saslMechanism), "SCRAM-") {
+		// A gs2 header of "y" means the client supports channel binding but thinks the server doesn't.
+		// https://datatracker.ietf.org/doc/html/rfc5802#section-6
+		initial, err := base64.StdEncoding.DecodeString(strings.TrimSpace(xmpp.Text(e)))
+		p.saslCBDowngrade = err == nil && strings.HasPrefix(string(initial), "y,")
+	}
+}
+
+// explainSASLFailure logs why a SASL <failure/> from the server was most likely caused by the proxy.
+func (p *Proxy) explainSASLFailure(e xmpp.Element) {
+	condition := saslFailureCondition(e)
+	switch {
+	case isChannelBinding(p.saslMechanism):
+		p.logger.Warnw("SASL failed because the client used channel binding. the TLS channel between the client and proxy is not the one between the proxy and server. set StripChannelBinding to hide these mechanisms",
+			"mechanism", p.saslMechanism,
+			"condition", condition,
+		)
+	case p.saslCBDowngrade && p.serverOffersCB:
+		p.logger.Warnw("SASL likely failed because channel binding mechanisms were hidden from a client that supports them. the server treats this as a downgrade attack. the client must be configured not to use channel binding",
+			"mechanism", p.saslMechanism,
+			"condition", condition,
+		)
+	default:
+		p.logger.Infow("SASL failed",
+			"mechanism", p.saslMechanism,
+			"condition", condition,
+		)
+	}
+}
+
+// saslFailureCondition returns the local name of the defined condition inside a SASL <failure/>.
+func saslFailureCondition(e xmpp.Element) string {
+	for _, child := range xmpp.Children(e) {
+		if child.Local != "text" {
+			return child.Local
+		}
+	}
+	return ""
+}
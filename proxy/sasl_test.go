@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const testCBMechanisms = `<stream:features>` +
+	`<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>SCRAM-SHA-1-PLUS</mechanism><mechanism>SCRAM-SHA-1</mechanism><mechanism>PLAIN</mechanism></mechanisms>` +
+	`<sasl-channel-binding xmlns='urn:xmpp:sasl-cb:0'><channel-binding type='tls-exporter'/></sasl-channel-binding>` +
+	`</stream:features>`
+
+func TestAllowMechanism(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		allow  map[string]bool
+	}{
+		{
+			name:  "everything",
+			allow: map[string]bool{"SCRAM-SHA-1-PLUS": true, "PLAIN": true},
+		},
+		{
+			name:   "strip channel binding",
+			config: Config{StripChannelBinding: true},
+			allow:  map[string]bool{"SCRAM-SHA-1-PLUS": false, "scram-sha-256-plus": false, "SCRAM-SHA-1": true, "PLAIN": true},
+		},
+		{
+			name:   "allow list",
+			config: Config{SASLMechanisms: []string{"scram-sha-1", "SCRAM-SHA-1-PLUS"}},
+			allow:  map[string]bool{"SCRAM-SHA-1": true, "SCRAM-SHA-1-PLUS": true, "PLAIN": false},
+		},
+		{
+			name:   "strip channel binding from the allow list",
+			config: Config{StripChannelBinding: true, SASLMechanisms: []string{"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"}},
+			allow:  map[string]bool{"SCRAM-SHA-1": true, "SCRAM-SHA-1-PLUS": false, "PLAIN": false},
+		},
+	}
+	for _, test := range tests {
+		for mechanism, want := range test.allow {
+			if got := test.config.allowMechanism(mechanism); got != want {
+				t.Errorf("%s: allowMechanism(%q) = %t, want %t", test.name, mechanism, got, want)
+			}
+		}
+	}
+}
+
+func TestStripChannelBinding(t *testing.T) {
+	addr := acceptOnce(t, func(c *testConn) {
+		c.expect("version='1.0'>")
+		c.send(testServerHeader + testCBMechanisms)
+		c.expect(testStreamEnd)
+		c.send(testStreamEnd)
+	})
+	c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", StripChannelBinding: true})
+	c.send(testClientHeader)
+	features := c.expect("</stream:features>")
+	if strings.Contains(features, "-PLUS") || strings.Contains(features, "sasl-channel-binding") {
+		t.Errorf("channel binding was offered to the client: %s", features)
+	}
+	if !strings.Contains(features, "<mechanism>SCRAM-SHA-1</mechanism><mechanism>PLAIN</mechanism>") {
+		t.Errorf("the other mechanisms weren't offered to the client: %s", features)
+	}
+	c.send(testStreamEnd)
+	c.expect(testStreamEnd)
+	c.Close()
+	if err := waitForRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExplainSASLFailure(t *testing.T) {
+	tests := []struct {
+		name                string
+		stripChannelBinding bool
+		auth                string
+		level               zapcore.Level
+		message             string // Prefix of the message that explains the failure
+	}{
+		{
+			name:    "channel binding",
+			auth:    `<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='SCRAM-SHA-1-PLUS'>` + base64.StdEncoding.EncodeToString([]byte("p=tls-exporter,,n=a,r=abc")) + `</auth>`,
+			level:   zap.WarnLevel,
+			message: "SASL failed because the client used channel binding",
+		},
+		{
+			name:                "hidden channel binding",
+			stripChannelBinding: true,
+			auth:                `<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='SCRAM-SHA-1'>` + base64.StdEncoding.EncodeToString([]byte("y,,n=a,r=abc")) + `</auth>`,
+			level:               zap.WarnLevel,
+			message:             "SASL likely failed because channel binding mechanisms were hidden",
+		},
+		{
+			name:                "client without channel binding",
+			stripChannelBinding: true,
+			auth:                `<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='SCRAM-SHA-1'>` + base64.StdEncoding.EncodeToString([]byte("n,,n=a,r=abc")) + `</auth>`,
+			level:               zap.InfoLevel,
+			message:             "SASL failed",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := acceptOnce(t, func(c *testConn) {
+				c.expect("version='1.0'>")
+				c.send(testServerHeader + testCBMechanisms)
+				c.expect("</auth>")
+				c.send(`<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>`)
+				c.expect(testStreamEnd)
+				c.send(testStreamEnd)
+			})
+			core, logs := observer.New(zap.InfoLevel)
+			c, done := runTestProxy(t, &Config{Address: addr, Domain: "example.com", StripChannelBinding: test.stripChannelBinding, Logger: zap.New(core).Sugar()})
+			c.send(testClientHeader)
+			c.expect("</stream:features>")
+			c.send(test.auth)
+			c.expect("</failure>")
+			c.send(testStreamEnd)
+			c.expect(testStreamEnd)
+			c.Close()
+			if err := waitForRun(t, done); err != nil {
+				t.Fatal(err)
+			}
+			var explained []observer.LoggedEntry
+			for _, entry := range logs.FilterField(zap.String("condition", "not-authorized")).All() {
+				if strings.HasPrefix(entry.Message, test.message) {
+					explained = append(explained, entry)
+				}
+			}
+			if len(explained) != 1 || explained[0].Level != test.level {
+				t.Fatalf("got %v, want one %s entry starting with %q", explained, test.level, test.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,331 @@
+package proxy
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+	"go.uber.org/zap"
+)
+
+// smCounter follows the XEP-0198 stanza count of one direction on both legs of the proxy.
+// Stanzas that the proxy drops, duplicates or injects make the count on the receiving leg drift from the count on the sending leg,
+// so acknowledgements from the receiver have to be translated before they are passed back to the sender.
+type smCounter struct {
+	counting bool
+	received uint32   // Stanzas received from the sender, which is the count the sender expects in acknowledgements
+	base     uint32   // Stanzas sent to the receiver that have already been acknowledged
+	acked    uint32   // The received count that base translates to
+	sent     []uint32 // sent[i] is the received count at the time the stanza number base+i+1 was sent to the receiver
+}
+
+// start begins counting from h stanzas on both legs.
+func (c *smCounter) start(h uint32) {
+	c.resume(h, h)
+}
+
+// resume continues counting from a resumed stream, after the receiver acknowledged base stanzas which the sender counts as received.
+// Stanzas that weren't acknowledged are sent again by the sender, so they are counted again.
+func (c *smCounter) resume(base, received uint32) {
+	c.counting = true
+	c.received = received
+	c.base = base
+	c.acked = received
+	c.sent = nil
+}
+
+// drift returns how far the count on the receiving leg is ahead of the count on the sending leg.
+func (c *smCounter) drift() int64 {
+	return int64(c.base) + int64(len(c.sent)) - int64(c.received)
+}
+
+// translate converts h, an acknowledgement from the receiver, into the count that the sender expects.
+func (c *smCounter) translate(h uint32) uint32 {
+	if !c.counting {
+		return h
+	}
+	// uint32 subtraction keeps working when the counters wrap around
+	n := h - c.base
+	switch {
+	case n == 0 || n > 1<<31:
+		// Nothing new, or a stale acknowledgement
+		return c.acked
+	case int64(n) >= int64(len(c.sent)):
+		// Everything that was sent has been handled, which also covers stanzas that were dropped after the last one sent.
+		c.acked = c.received
+		c.sent = nil
+	default:
+		c.acked = c.sent[n-1]
+		c.sent = c.sent[n:]
+	}
+	c.base = h
+	return c.acked
+}
+
+// smResumeTimeout is how long the counters of a resumable stream are kept after its session ended, if the server didn't say
+// how long it keeps the stream.
+const smResumeTimeout = 10 * time.Minute
+
+// smStreams holds the trackers of resumable streams by their Stream Management id. A stream is resumed by a new session, which
+// takes over the counters of the session that was interrupted, so that its h values are translated like they were before.
+var smStreams = struct {
+	sync.Mutex
+	m map[string]*smStream
+}{m: map[string]*smStream{}}
+
+type smStream struct {
+	tracker *smTracker
+	expires time.Time // Zero while the session of tracker is running
+}
+
+// smTracker watches Stream Management (XEP-0198) on both legs of a Proxy and rewrites h values so that sessions stay
+// valid even when the proxy adds or removes stanzas.
+type smTracker struct {
+	mu        sync.Mutex
+	c2s       smCounter // Stanzas sent by the client and acknowledged by the server
+	s2c       smCounter // Stanzas sent by the server and acknowledged by the client
+	id        string
+	resumeH   uint32 // h of the client's resume request, as the client sent it
+	resumeSH  uint32 // h of the client's resume request, as it was sent to the server
+	resumeID  string
+	resumable bool
+	max       time.Duration // How long the server keeps the stream resumable
+	logger    *zap.SugaredLogger
+}
+
+func newSMTracker(logger *zap.SugaredLogger) *smTracker {
+	return &smTracker{logger: logger}
+}
+
+func (t *smTracker) counter(direction Direction) *smCounter {
+	if direction == ClientToServer {
+		return &t.c2s
+	}
+	return &t.s2c
+}
+
+// Received counts a stanza that the proxy read from the sending side of direction.
+func (t *smTracker) Received(direction Direction, e xmpp.Element) {
+	if !isStanza(e) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c := t.counter(direction); c.counting {
+		c.received++
+	}
+}
+
+// Sent counts a stanza that the proxy wrote to the receiving side of direction.
+func (t *smTracker) Sent(direction Direction, e xmpp.Element) {
+	if !isStanza(e) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c := t.counter(direction); c.counting {
+		c.sent = append(c.sent, c.received)
+	}
+}
+
+// Rewrite inspects a Stream Management element travelling in direction and returns the element that should be forwarded in its place.
+func (t *smTracker) Rewrite(direction Direction, e xmpp.Element) (xmpp.Element, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch e.Name().Local {
+	case "enable":
+		// The client counts outbound stanzas from the moment it sends enable
+		t.c2s.start(0)
+		resume, _ := xmpp.Attr(e, "resume")
+		t.logger.Infow("stream management requested",
+			"resume", resume,
+		)
+	case "enabled":
+		// The server counts outbound stanzas from the moment it sends enabled
+		t.s2c.start(0)
+		t.id, _ = xmpp.Attr(e, "id")
+		resume, _ := xmpp.Attr(e, "resume")
+		t.resumable = resume == "true" || resume == "1"
+		max, _ := xmpp.Attr(e, "max")
+		if seconds, err := strconv.ParseUint(max, 10, 32); err == nil {
+			t.max = time.Duration(seconds) * time.Second
+		}
+		t.logger.Infow("stream management enabled",
+			"smID", t.id,
+			"resumable", t.resumable,
+			"max", max,
+		)
+		if t.resumable && t.id != "" {
+			t.register()
+		}
+	case "resume":
+		t.resumeID, _ = xmpp.Attr(e, "previd")
+		h, ok := parseH(e)
+		if !ok {
+			break
+		}
+		resumed := t.takeOver(t.resumeID)
+		// The client acknowledges the stanzas the server sent on the interrupted stream, which are counted by s2c
+		t.resumeH, t.resumeSH = h, t.s2c.translate(h)
+		t.logger.Infow("stream resumption requested",
+			"previd", t.resumeID,
+			"h", h,
+			"countersKept", resumed,
+		)
+		if t.resumeSH != h {
+			return t.rewriteH(direction, e, h, t.resumeSH, t.s2c.drift())
+		}
+	case "resumed":
+		h, ok := parseH(e)
+		if !ok {
+			break
+		}
+		translated := t.c2s.translate(h)
+		// A resumed stream continues counting where the previous stream left off
+		t.c2s.resume(h, translated)
+		t.s2c.resume(t.resumeH, t.resumeSH)
+		t.id = t.resumeID
+		t.logger.Infow("stream resumed",
+			"previd", t.resumeID,
+			"h", h,
+		)
+		t.register()
+		if translated != h {
+			return t.rewriteH(direction, e, h, translated, t.c2s.drift())
+		}
+	case "failed":
+		t.logger.Infow("stream management failed",
+			"direction", direction,
+			"previd", t.resumeID,
+		)
+		if t.resumeID != "" {
+			// The server has given up on the stream, so its counters won't be needed again
+			smStreams.Lock()
+			delete(smStreams.m, t.resumeID)
+			smStreams.Unlock()
+		}
+	case "a":
+		// An acknowledgement travelling in one direction acknowledges the stanzas of the opposite direction
+		acked := &t.c2s
+		if direction == ClientToServer {
+			acked = &t.s2c
+		}
+		h, ok := parseH(e)
+		if !ok {
+			break
+		}
+		translated := acked.translate(h)
+		if translated != h {
+			return t.rewriteH(direction, e, h, translated, acked.drift())
+		}
+	}
+	return e, nil
+}
+
+func (t *smTracker) rewriteH(direction Direction, e xmpp.Element, h, translated uint32, drift int64) (xmpp.Element, error) {
+	t.logger.Infow("rewriting stream management acknowledgement",
+		"direction", direction,
+		"element", e.Name().Local,
+		"h", h,
+		"rewrittenH", translated,
+		"drift", drift,
+	)
+	return xmpp.WithAttr(e, "h", strconv.FormatUint(uint64(translated), 10))
+}
+
+// register makes t the tracker of the stream t.id, so that a session resuming the stream can take over its counters
+func (t *smTracker) register() {
+	smStreams.Lock()
+	defer smStreams.Unlock()
+	forgetExpiredSMStreams()
+	smStreams.m[t.id] = &smStream{tracker: t}
+}
+
+// forgetExpiredSMStreams removes the streams that can't be resumed any more. smStreams must be locked.
+func forgetExpiredSMStreams() {
+	now := time.Now()
+	for id, s := range smStreams.m {
+		if !s.expires.IsZero() && now.After(s.expires) {
+			delete(smStreams.m, id)
+		}
+	}
+}
+
+// takeOver copies the counters of the stream id from the session that was interrupted, and returns false if there are none.
+func (t *smTracker) takeOver(id string) bool {
+	smStreams.Lock()
+	forgetExpiredSMStreams()
+	s, ok := smStreams.m[id]
+	smStreams.Unlock()
+	if !ok || s.tracker == t {
+		return false
+	}
+	prev := s.tracker
+	prev.mu.Lock()
+	defer prev.mu.Unlock()
+	t.c2s, t.s2c = prev.c2s, prev.s2c
+	t.c2s.sent = append([]uint32(nil), prev.c2s.sent...)
+	t.s2c.sent = append([]uint32(nil), prev.s2c.sent...)
+	t.resumable, t.max = prev.resumable, prev.max
+	return true
+}
+
+// Ended starts the time after which the stream of t can't be resumed any more, once its session has ended
+func (t *smTracker) Ended() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.id == "" {
+		return
+	}
+	max := t.max
+	if max == 0 {
+		max = smResumeTimeout
+	}
+	smStreams.Lock()
+	defer smStreams.Unlock()
+	if s, ok := smStreams.m[t.id]; ok && s.tracker == t {
+		s.expires = time.Now().Add(max)
+	}
+}
+
+// LogSummary logs the Stream Management state of the session.
+func (t *smTracker) LogSummary() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.c2s.counting && !t.s2c.counting {
+		return
+	}
+	t.logger.Infow("stream management summary",
+		"smID", t.id,
+		"resumable", t.resumable,
+		"clientStanzas", t.c2s.received,
+		"clientStanzasUnacked", len(t.c2s.sent),
+		"clientStanzaDrift", t.c2s.drift(),
+		"serverStanzas", t.s2c.received,
+		"serverStanzasUnacked", len(t.s2c.sent),
+		"serverStanzaDrift", t.s2c.drift(),
+	)
+}
+
+func parseH(e xmpp.Element) (uint32, bool) {
+	v, ok := xmpp.Attr(e, "h")
+	if !ok {
+		return 0, false
+	}
+	h, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(h), true
+}
+
+// isStanza returns true if e is a message, presence or iq stanza, which are the elements counted by Stream Management.
+func isStanza(e xmpp.Element) bool {
+	switch e.(type) {
+	case *xmpp.Message, *xmpp.Presence, *xmpp.IQ:
+		return true
+	}
+	return false
+}
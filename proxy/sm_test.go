@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+	"go.uber.org/zap"
+)
+
+// decodeElement decodes s as an element of a client stream
+func decodeElement(t *testing.T, s string) xmpp.Element {
+	t.Helper()
+	d := xmpp.NewDecoder(strings.NewReader(testClientHeader + s))
+	if _, err := d.NextElement(); err != nil {
+		t.Fatal(err)
+	}
+	e, err := d.NextElement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// rewriteSM passes the Stream Management element s through t and returns its h afterwards
+func rewriteSM(t *testing.T, tracker *smTracker, direction Direction, s string) string {
+	t.Helper()
+	e, err := tracker.Rewrite(direction, decodeElement(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := xmpp.Attr(e, "h")
+	return h
+}
+
+// smSession plays the part of a Proxy forwarding stanzas, of which it drops or injects some
+type smSession struct {
+	t       *testing.T
+	tracker *smTracker
+}
+
+func newSMSession(t *testing.T) *smSession {
+	s := &smSession{t: t, tracker: newSMTracker(zap.NewNop().Sugar())}
+	// Resumable streams are registered for the whole process, so a test run again with -count must not find them
+	t.Cleanup(func() {
+		smStreams.Lock()
+		defer smStreams.Unlock()
+		for id, stream := range smStreams.m {
+			if stream.tracker == s.tracker {
+				delete(smStreams.m, id)
+			}
+		}
+	})
+	return s
+}
+
+// forward passes n stanzas in direction, of which dropped aren't forwarded and injected more are added
+func (s *smSession) forward(direction Direction, n, dropped, injected int) {
+	stanza := decodeElement(s.t, `<message><body>hi</body></message>`)
+	for i := 0; i < n; i++ {
+		s.tracker.Received(direction, stanza)
+		if i >= dropped {
+			s.tracker.Sent(direction, stanza)
+		}
+	}
+	for i := 0; i < injected; i++ {
+		s.tracker.Sent(direction, stanza)
+	}
+}
+
+func (s *smSession) enable(id string) {
+	rewriteSM(s.t, s.tracker, ClientToServer, `<enable xmlns='urn:xmpp:sm:3' resume='true'/>`)
+	rewriteSM(s.t, s.tracker, ServerToClient, `<enabled xmlns='urn:xmpp:sm:3' id='`+id+`' resume='true'/>`)
+}
+
+func TestSMAcknowledgement(t *testing.T) {
+	s := newSMSession(t)
+	s.enable("ack")
+	// The server sends 3 stanzas, of which the proxy drops 1, so the client acknowledges 2
+	s.forward(ServerToClient, 3, 1, 0)
+	if h := rewriteSM(t, s.tracker, ClientToServer, `<a xmlns='urn:xmpp:sm:3' h='2'/>`); h != "3" {
+		t.Errorf("client acknowledgement was rewritten to %s, want 3", h)
+	}
+	// The client sends 2 stanzas, and the proxy injects 1, so the server acknowledges 3
+	s.forward(ClientToServer, 2, 0, 1)
+	if h := rewriteSM(t, s.tracker, ServerToClient, `<a xmlns='urn:xmpp:sm:3' h='3'/>`); h != "2" {
+		t.Errorf("server acknowledgement was rewritten to %s, want 2", h)
+	}
+}
+
+func TestSMResumption(t *testing.T) {
+	interrupted := newSMSession(t)
+	interrupted.enable("resumption")
+	interrupted.forward(ServerToClient, 3, 1, 0)
+	interrupted.forward(ClientToServer, 2, 0, 1)
+	interrupted.tracker.Ended()
+
+	s := newSMSession(t)
+	// The client got 2 of the 3 stanzas the server sent, and the server got 3 stanzas of which the client sent 2
+	if h := rewriteSM(t, s.tracker, ClientToServer, `<resume xmlns='urn:xmpp:sm:3' previd='resumption' h='2'/>`); h != "3" {
+		t.Errorf("resume was rewritten to h=%s, want 3", h)
+	}
+	if h := rewriteSM(t, s.tracker, ServerToClient, `<resumed xmlns='urn:xmpp:sm:3' previd='resumption' h='3'/>`); h != "2" {
+		t.Errorf("resumed was rewritten to h=%s, want 2", h)
+	}
+
+	// The resumed stream keeps the drift of the interrupted one
+	s.forward(ServerToClient, 1, 0, 0)
+	if h := rewriteSM(t, s.tracker, ClientToServer, `<a xmlns='urn:xmpp:sm:3' h='3'/>`); h != "4" {
+		t.Errorf("client acknowledgement was rewritten to %s, want 4", h)
+	}
+	s.forward(ClientToServer, 1, 0, 0)
+	if h := rewriteSM(t, s.tracker, ServerToClient, `<a xmlns='urn:xmpp:sm:3' h='4'/>`); h != "3" {
+		t.Errorf("server acknowledgement was rewritten to %s, want 3", h)
+	}
+}
+
+func TestSMResumptionWithoutCounters(t *testing.T) {
+	// The stream wasn't enabled through this proxy, so there's nothing to translate
+	s := newSMSession(t)
+	if h := rewriteSM(t, s.tracker, ClientToServer, `<resume xmlns='urn:xmpp:sm:3' previd='unknown' h='5'/>`); h != "5" {
+		t.Errorf("resume was rewritten to h=%s, want it unchanged", h)
+	}
+	if h := rewriteSM(t, s.tracker, ServerToClient, `<resumed xmlns='urn:xmpp:sm:3' previd='unknown' h='7'/>`); h != "7" {
+		t.Errorf("resumed was rewritten to h=%s, want it unchanged", h)
+	}
+	s.forward(ServerToClient, 2, 1, 0)
+	if h := rewriteSM(t, s.tracker, ClientToServer, `<a xmlns='urn:xmpp:sm:3' h='6'/>`); h != "7" {
+		t.Errorf("client acknowledgement was rewritten to %s, want 7", h)
+	}
+}
+
+func TestSMResumptionFailed(t *testing.T) {
+	interrupted := newSMSession(t)
+	interrupted.enable("failed")
+	interrupted.forward(ServerToClient, 2, 1, 0)
+	interrupted.tracker.Ended()
+
+	s := newSMSession(t)
+	rewriteSM(t, s.tracker, ClientToServer, `<resume xmlns='urn:xmpp:sm:3' previd='failed' h='1'/>`)
+	rewriteSM(t, s.tracker, ServerToClient, `<failed xmlns='urn:xmpp:sm:3'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></failed>`)
+	smStreams.Lock()
+	_, kept := smStreams.m["failed"]
+	smStreams.Unlock()
+	if kept {
+		t.Error("counters of a stream that the server failed to resume were kept")
+	}
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/xmpp"
+)
+
+// SRV services looked up for the backend domain. Targets of xmpps-client expect TLS as soon as they are connected to (XEP-0368).
+const (
+	srvServiceXMPP  = "xmpp-client"
+	srvServiceXMPPS = "xmpps-client"
+)
+
+var errNoSRVTargets = errors.New("no SRV records found")
+
+// srvTarget is a host and port taken from an SRV record
+type srvTarget struct {
+	net.SRV
+	service string
+}
+
+func (t srvTarget) address() string {
+	return net.JoinHostPort(t.Target, strconv.Itoa(int(t.Port)))
+}
+
+func (t srvTarget) directTLS() bool {
+	return t.service == srvServiceXMPPS
+}
+
+// resolver returns the resolver used for SRV lookups, which queries Config.SRVResolver if it's set
+func (p *Proxy) resolver() *net.Resolver {
+	if p.Config.SRVResolver == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, p.Config.SRVResolver)
+		},
+	}
+}
+
+// lookupSRV returns the targets of both SRV services of domain in the order they should be tried.
+func (p *Proxy) lookupSRV(ctx context.Context, domain string) ([]srvTarget, error) {
+	var targets []srvTarget
+	var lookupErr error
+	for _, service := range []string{srvServiceXMPP, srvServiceXMPPS} {
+		_, records, err := p.resolver().LookupSRV(ctx, service, "tcp", domain)
+		if err != nil {
+			lookupErr = err
+			continue
+		}
+		for _, r := range records {
+			// A single record with a target of "." means the service is decidedly not available
+			if r.Target == "." {
+				continue
+			}
+			targets = append(targets, srvTarget{SRV: *r, service: service})
+		}
+	}
+	if len(targets) == 0 {
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		return nil, errNoSRVTargets
+	}
+	return orderSRV(targets), nil
+}
+
+// orderSRV sorts targets by priority, and within a priority picks them at random weighted by their weight.
+// https://datatracker.ietf.org/doc/html/rfc2782
+func orderSRV(targets []srvTarget) []srvTarget {
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].Priority < targets[j].Priority })
+	for start := 0; start < len(targets); {
+		end := start + 1
+		for end < len(targets) && targets[end].Priority == targets[start].Priority {
+			end++
+		}
+		shuffleByWeight(targets[start:end])
+		start = end
+	}
+	return targets
+}
+
+// shuffleByWeight orders targets of the same priority with the weighted selection of RFC 2782. Targets with a weight of 0 are
+// put first, which gives them a small chance of being picked before the others.
+func shuffleByWeight(targets []srvTarget) {
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].Weight == 0 && targets[j].Weight != 0 })
+	for len(targets) > 1 {
+		sum := 0
+		for _, t := range targets {
+			sum += int(t.Weight)
+		}
+		// The first target whose running sum reaches a random number between 0 and sum inclusive is picked
+		n := rand.Intn(sum + 1)
+		s := 0
+		for i, t := range targets {
+			s += int(t.Weight)
+			if s >= n {
+				// The targets that weren't picked keep their order, so that the ones with a weight of 0 stay in front
+				copy(targets[1:i+1], targets[:i])
+				targets[0] = t
+				break
+			}
+		}
+		targets = targets[1:]
+	}
+}
+
+// connectSRV tries the SRV targets of the backend domain in order until one of them accepts the connection.
+// All of the attempts together have to finish within timeout.
+// Config.Address is dialed instead if the domain has no SRV records.
+func (p *Proxy) connectSRV(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	targets, err := p.lookupSRV(ctx, p.domain)
+	if err != nil {
+		p.logger.Warnw("SRV lookup failed. falling back to the configured address",
+			"domain", p.domain,
+			"reason", err.Error(),
+			"serverAddr", p.serverAddr,
+		)
+		conn, err := p.dialServer(&net.Dialer{Deadline: deadline}, p.serverAddr)
+		if err != nil {
+			return err
+		}
+		return p.SetServerConn(conn)
+	}
+
+	var lastErr error
+	for _, target := range targets {
+		if time.Now().After(deadline) {
+			lastErr = fmt.Errorf("connect timeout exceeded after trying %s", target.address())
+			break
+		}
+		if err := p.dialSRVTarget(target, deadline); err != nil {
+			p.logger.Warnw("failed to connect to SRV target",
+				"service", target.service,
+				"target", target.address(),
+				"reason", err.Error(),
+			)
+			lastErr = err
+			continue
+		}
+		p.serverAddr = target.address()
+		p.logger.Infow("connected to SRV target",
+			"service", target.service,
+			"target", target.address(),
+			"priority", target.Priority,
+			"weight", target.Weight,
+		)
+		return nil
+	}
+	return fmt.Errorf("no SRV target of %s could be reached: %s", p.domain, lastErr)
+}
+
+// dialSRVTarget connects to target, and completes the TLS handshake right away if the target is for direct TLS.
+// The target's host is resolved by the same resolver as the SRV records.
+func (p *Proxy) dialSRVTarget(target srvTarget, deadline time.Time) error {
+	conn, err := p.dialServer(&net.Dialer{Deadline: deadline, Resolver: p.resolver()}, target.address())
+	if err != nil {
+		return err
+	}
+	if !target.directTLS() {
+		return p.SetServerConn(conn)
+	}
+
+	tlsConn := tls.Client(conn, &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         p.domain,
+		NextProtos:         []string{"xmpp-client"},
+	})
+	conn.SetDeadline(deadline)
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	p.server.baseConn = conn
+	p.serverDirectTLS = true
+	if err := p.SetServerConn(tlsConn); err != nil {
+		return err
+	}
+	p.tlsUpgraded(Server, tlsConn.ConnectionState())
+	return nil
+}
+
+// offerLocalTLS adds STARTTLS to the stream features of a server that was connected to with direct TLS, so that the client
+// can still upgrade its own connection. The features are kept to answer the stream restart that follows.
+func (p *Proxy) offerLocalTLS(e xmpp.Element) (xmpp.Element, error) {
+	if !p.serverDirectTLS || p.clientTLS || p.Config.TLSConfig == nil {
+		return e, nil
+	}
+	p.serverFeatures = e
+	return xmpp.WithChild(e, fmt.Sprintf("<starttls xmlns='%s'/>", xmpp.NSTLS))
+}
+
+// startLocalTLS answers STARTTLS from the client on behalf of a server that is already on TLS.
+func (p *Proxy) startLocalTLS() error {
+	if err := p.SendClient(fmt.Sprintf("<proceed xmlns='%s'/>", xmpp.NSTLS)); err != nil {
+		return err
+	}
+	if err := p.StartTLSWithClient(); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.localTLSRestart = true
+	p.mu.Unlock()
+	return nil
+}
+
+// answerLocalTLSRestart sends the client the server's stream header and features in response to the stream restart after a
+// STARTTLS answered by startLocalTLS. The server never took part in the upgrade, so the restart isn't forwarded.
+func (p *Proxy) answerLocalTLSRestart() error {
+	p.mu.Lock()
+	p.localTLSRestart = false
+	p.mu.Unlock()
+	if err := p.SendClient(p.server.Stream.XML()); err != nil {
+		return err
+	}
+	p.logger.Infow("answered the stream restart after STARTTLS with the server's stream features")
+	return p.SendClient(p.serverFeatures.XML())
+}
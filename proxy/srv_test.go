@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// DNS record types answered by dnsStub
+const (
+	dnsTypeA   = 1
+	dnsTypeSRV = 33
+)
+
+// dnsStub is a DNS server that answers SRV and A queries from its maps. Names are fully qualified e.g. _xmpp-client._tcp.example.com.
+type dnsStub struct {
+	srv   map[string][]net.SRV
+	a     map[string]net.IP
+	delay map[string]time.Duration // Answers for these names are held back
+}
+
+// start serves the stub on a local UDP port and returns its address
+func (s *dnsStub) start(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := append([]byte(nil), buf[:n]...)
+			go func() {
+				resp, name := s.answer(query)
+				if resp == nil {
+					return
+				}
+				time.Sleep(s.delay[name])
+				conn.WriteTo(resp, addr)
+			}()
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// answer returns the response to query and the name that was asked for
+func (s *dnsStub) answer(query []byte) ([]byte, string) {
+	if len(query) < 12 {
+		return nil, ""
+	}
+	var labels []string
+	i := 12
+	for i < len(query) && query[i] != 0 {
+		length := int(query[i])
+		if i+1+length > len(query) {
+			return nil, ""
+		}
+		labels = append(labels, string(query[i+1:i+1+length]))
+		i += length + 1
+	}
+	if i+5 > len(query) {
+		return nil, ""
+	}
+	name := strings.ToLower(strings.Join(labels, ".")) + "."
+	qtype := binary.BigEndian.Uint16(query[i+1:])
+	question := query[12 : i+5]
+
+	var answers [][]byte
+	switch qtype {
+	case dnsTypeSRV:
+		for _, r := range s.srv[name] {
+			data := make([]byte, 6)
+			binary.BigEndian.PutUint16(data, r.Priority)
+			binary.BigEndian.PutUint16(data[2:], r.Weight)
+			binary.BigEndian.PutUint16(data[4:], r.Port)
+			answers = append(answers, append(data, encodeDNSName(r.Target)...))
+		}
+	case dnsTypeA:
+		if ip := s.a[name].To4(); ip != nil {
+			answers = append(answers, ip)
+		}
+	}
+	_, isSRV := s.srv[name]
+	_, isA := s.a[name]
+	rcode := uint16(0)
+	if !isSRV && !isA {
+		rcode = 3 // NXDOMAIN
+	}
+
+	resp := make([]byte, 12)
+	copy(resp, query[:2])
+	binary.BigEndian.PutUint16(resp[2:], 0x8180|rcode)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+	resp = append(resp, question...)
+	for _, data := range answers {
+		// The name of every answer points back at the question
+		rr := []byte{0xc0, 0x0c, 0, 0, 0, 1, 0, 0, 0, 60, 0, 0}
+		binary.BigEndian.PutUint16(rr[2:], qtype)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(data)))
+		resp = append(append(resp, rr...), data...)
+	}
+	return resp, name
+}
+
+func encodeDNSName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func portOf(t *testing.T, addr string) uint16 {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := strconv.Atoi(port)
+	return uint16(n)
+}
+
+func contextWithTimeout(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestLookupSRVMergesServices(t *testing.T) {
+	dns := (&dnsStub{srv: map[string][]net.SRV{
+		"_xmpp-client._tcp.example.com.":  {{Target: "b.example.com.", Port: 5222, Priority: 20}, {Target: "a.example.com.", Port: 5222, Priority: 10}},
+		"_xmpps-client._tcp.example.com.": {{Target: "c.example.com.", Port: 5223, Priority: 15}, {Target: ".", Port: 0, Priority: 0}},
+	}}).start(t)
+	p := newTestProxy(t, &Config{Domain: "example.com", SRVResolver: dns})
+
+	targets, err := p.lookupSRV(contextWithTimeout(t), "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, target := range targets {
+		got = append(got, target.service+" "+target.address())
+	}
+	want := []string{
+		"xmpp-client a.example.com.:5222",
+		"xmpps-client c.example.com.:5223",
+		"xmpp-client b.example.com.:5222",
+	}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !targets[1].directTLS() || targets[0].directTLS() {
+		t.Error("only xmpps-client targets should use direct TLS")
+	}
+}
+
+func TestOrderSRVPriority(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		targets := orderSRV([]srvTarget{
+			{SRV: net.SRV{Target: "c", Priority: 30, Weight: 50}},
+			{SRV: net.SRV{Target: "a", Priority: 10, Weight: 0}},
+			{SRV: net.SRV{Target: "b", Priority: 20, Weight: 1}},
+			{SRV: net.SRV{Target: "b", Priority: 20, Weight: 100}},
+		})
+		var got string
+		for _, target := range targets {
+			got += target.Target
+		}
+		if got != "abbc" {
+			t.Fatalf("got %s, want the targets ordered by priority", got)
+		}
+	}
+}
+
+func TestOrderSRVWeight(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []uint16
+		min     float64 // Bounds of how often the first target is picked first
+		max     float64
+	}{
+		// The random number of RFC 2782 is drawn from 0 to the sum of the weights inclusive, so the first target is picked
+		// first with a chance of (weight+1)/(sum+1)
+		{name: "weighted", weights: []uint16{10, 30}, min: 0.22, max: 0.32},
+		{name: "equal", weights: []uint16{50, 50}, min: 0.45, max: 0.56},
+		// Which gives a target with a weight of 0 a small chance if there are weighted ones
+		{name: "zero and weighted", weights: []uint16{0, 9}, min: 0.05, max: 0.15},
+		{name: "weighted and zero", weights: []uint16{9, 0}, min: 0.85, max: 0.95},
+		{name: "all zero", weights: []uint16{0, 0}, min: 0.99, max: 1},
+	}
+	const runs = 4000
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first := 0
+			for i := 0; i < runs; i++ {
+				var targets []srvTarget
+				for j, w := range test.weights {
+					targets = append(targets, srvTarget{SRV: net.SRV{Port: uint16(j), Weight: w}})
+				}
+				targets = orderSRV(targets)
+				if len(targets) != len(test.weights) {
+					t.Fatalf("got %d targets, want %d", len(targets), len(test.weights))
+				}
+				if targets[0].Port == 0 {
+					first++
+				}
+			}
+			if share := float64(first) / runs; share < test.min || share > test.max {
+				t.Errorf("first target was picked first %.3f of the time, want %.2f to %.2f", share, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestConnectSRVFailover(t *testing.T) {
+	accepted := make(chan struct{})
+	live := acceptOnce(t, func(c *testConn) { close(accepted) })
+	dns := (&dnsStub{
+		srv: map[string][]net.SRV{
+			"_xmpp-client._tcp.example.com.": {
+				{Target: "dead.example.com.", Port: portOf(t, closedAddr(t)), Priority: 10},
+				{Target: "live.example.com.", Port: portOf(t, live), Priority: 20},
+			},
+		},
+		a: map[string]net.IP{
+			"dead.example.com.": net.IPv4(127, 0, 0, 1),
+			"live.example.com.": net.IPv4(127, 0, 0, 1),
+		},
+	}).start(t)
+	p := newTestProxy(t, &Config{Address: closedAddr(t), Domain: "example.com", SRVResolver: dns})
+
+	if err := p.connectSRV(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	defer p.server.Conn.Close()
+	if want := net.JoinHostPort("live.example.com.", strconv.Itoa(int(portOf(t, live)))); p.ServerAddr() != want {
+		t.Errorf("connected to %s, want %s", p.ServerAddr(), want)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(testTimeout):
+		t.Error("live target wasn't connected to")
+	}
+}
+
+func TestConnectSRVTimeout(t *testing.T) {
+	live := acceptOnce(t, func(c *testConn) {})
+	dns := (&dnsStub{
+		srv: map[string][]net.SRV{
+			"_xmpp-client._tcp.example.com.": {
+				{Target: "slow.example.com.", Port: portOf(t, live), Priority: 10},
+				{Target: "live.example.com.", Port: portOf(t, live), Priority: 20},
+			},
+		},
+		a: map[string]net.IP{
+			"slow.example.com.": net.IPv4(127, 0, 0, 1),
+			"live.example.com.": net.IPv4(127, 0, 0, 1),
+		},
+		delay: map[string]time.Duration{"slow.example.com.": time.Second},
+	}).start(t)
+	p := newTestProxy(t, &Config{Domain: "example.com", SRVResolver: dns})
+
+	// All of the targets share the timeout, so the one after the slow target isn't tried any more
+	const timeout = 300 * time.Millisecond
+	start := time.Now()
+	if err := p.connectSRV(timeout); err == nil {
+		p.server.Conn.Close()
+		t.Fatal("connected although the timeout was exceeded")
+	}
+	if elapsed := time.Since(start); elapsed > timeout+200*time.Millisecond {
+		t.Errorf("connecting took %s, want at most %s", elapsed, timeout)
+	}
+}
+
+func TestConnectSRVFallback(t *testing.T) {
+	accepted := make(chan struct{})
+	addr := acceptOnce(t, func(c *testConn) { close(accepted) })
+	dns := (&dnsStub{}).start(t)
+	p := newTestProxy(t, &Config{Address: addr, Domain: "example.com", SRVResolver: dns})
+
+	if err := p.connectSRV(testTimeout); err != nil {
+		t.Fatal(err)
+	}
+	defer p.server.Conn.Close()
+	if p.ServerAddr() != addr {
+		t.Errorf("connected to %s, want the configured address %s", p.ServerAddr(), addr)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(testTimeout):
+		t.Error("configured address wasn't connected to")
+	}
+}
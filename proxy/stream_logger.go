@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ByteCounts counts the bytes read from and written to a connection. It's shared by the StreamLoggers of a connection, so that TLS and compression don't reset it.
+type ByteCounts struct {
+	Read    int64
+	Written int64
+}
+
+type StreamLoggerConfig struct {
+	Src                io.ReadWriter // Actual IO stream that gets logged
+	Dest               io.Writer     // The destination io.Writer
+	TimeFormat         string        // Time Format string to include a timestamp immediately before every Read() and Write() from Src
+	ReadPrefix         []byte        // Slice of bytes that gets written to Dest immediately before every Read() from Src
+	ReadSuffix         []byte        // Slice of bytes that gets written to Dest immediately after every Read() from Src
+	WritePrefix        []byte        // Slice of bytes that gets written to Dest immediately before every Write() to Src
+	WriteSuffix        []byte        // Slice of bytes that gets written to Dest immediately after every Write() to Src
+	InjectPrefix       []byte        // Slice of bytes that gets written to Dest immediately before every WriteInjected() to Src
+	KeepaliveSuffix    []byte        // Slice of bytes that replaces ReadSuffix or WriteSuffix for keepalives
+	SuppressKeepalives bool          // Skip keepalives instead of writing them to Dest
+	HoldWhitespace     bool          // Hold back reads that are only whitespace until MarkKeepalive or the next read tells whether they were a keepalive
+	MarkLength         bool          // Write the length of reads and writes that span lines after their prefix, so that Dest can be split into them exactly
+	Counts             *ByteCounts   // If set, the bytes read from and written to Src are added to it
+}
+
+// Logs all reads and writes on a source io.ReadWriter by writing it to a destination io.Writer.
+// Whether data is a keepalive is only known once it has been decoded, so reads are marked as keepalives by MarkKeepalive and
+// writes by WriteKeepalive. Whitespace inside an element is logged like any other data.
+type StreamLogger struct {
+	Config *StreamLoggerConfig
+	held   []byte    // A read that is only whitespace, held back if HoldWhitespace is set
+	heldAt time.Time // When held was read
+}
+
+func NewStreamLogger(c *StreamLoggerConfig) *StreamLogger {
+	// TimeFormat:    "2006-01-02T15:04:05.000000",
+	// Config.Src: Config.Src,
+	// Config.Dest:    Config.Dest,
+	return &StreamLogger{
+		Config: c,
+	}
+}
+
+func (l *StreamLogger) Read(p []byte) (n int, err error) {
+	// Reading on means that the held whitespace was part of an element rather than a keepalive
+	if err := l.logHeld(false); err != nil {
+		return 0, err
+	}
+	n, err = l.Config.Src.Read(p)
+	l.count(true, n)
+	if n > 0 {
+		if l.Config.HoldWhitespace && isKeepalive(p[:n]) {
+			l.held, l.heldAt = append([]byte(nil), p[:n]...), time.Now()
+			return
+		}
+		if err := l.logRead(time.Now(), p[:n], false); err != nil {
+			return n, err
+		}
+	}
+	return
+}
+
+// MarkKeepalive logs the read held back by HoldWhitespace as a keepalive. It's called once the decoder reading from l has returned
+// the whitespace as an element of its own.
+func (l *StreamLogger) MarkKeepalive() {
+	l.logHeld(true)
+}
+
+// StopHolding logs the read held back by HoldWhitespace as it is and turns HoldWhitespace off, for when nothing decodes the reads any more.
+func (l *StreamLogger) StopHolding() {
+	l.logHeld(false)
+	l.Config.HoldWhitespace = false
+}
+
+// logHeld logs the read held back by HoldWhitespace, if there is one.
+func (l *StreamLogger) logHeld(keepalive bool) error {
+	if l.held == nil {
+		return nil
+	}
+	held := l.held
+	l.held = nil
+	return l.logRead(l.heldAt, held, keepalive)
+}
+
+// logRead logs p, which was read at the time at.
+func (l *StreamLogger) logRead(at time.Time, p []byte, keepalive bool) error {
+	if keepalive && l.Config.SuppressKeepalives {
+		return nil
+	}
+	if len(l.Config.ReadPrefix) > 0 {
+		l.Config.Dest.Write([]byte(at.Format(l.Config.TimeFormat)))
+		l.Config.Dest.Write(l.Config.ReadPrefix)
+		l.Config.Dest.Write(l.lengthMarker(p))
+	}
+	if _, err := l.Config.Dest.Write(p); err != nil {
+		return err
+	}
+	l.Config.Dest.Write(l.suffix(l.Config.ReadSuffix, keepalive))
+	return nil
+}
+
+func (l *StreamLogger) Write(p []byte) (n int, err error) {
+	return l.write(p, l.Config.WritePrefix, false)
+}
+
+// WriteInjected writes p to Src like Write, but marks it in Dest with InjectPrefix so that it can be told apart from proxied traffic.
+func (l *StreamLogger) WriteInjected(p []byte) (n int, err error) {
+	return l.write(p, l.Config.InjectPrefix, false)
+}
+
+// WriteKeepalive writes p to Src like Write, but marks it in Dest as a keepalive. p is whitespace that was decoded between elements.
+func (l *StreamLogger) WriteKeepalive(p []byte) (n int, err error) {
+	return l.write(p, l.Config.WritePrefix, true)
+}
+
+func (l *StreamLogger) write(p []byte, prefix []byte, keepalive bool) (n int, err error) {
+	if len(p) <= 0 {
+		return
+	}
+	defer func() { l.count(false, n) }()
+
+	if keepalive && l.Config.SuppressKeepalives {
+		return l.Config.Src.Write(p)
+	}
+
+	if _, err := l.Config.Dest.Write([]byte(time.Now().Format(l.Config.TimeFormat))); err != nil {
+		return 0, err
+	}
+
+	if _, err := l.Config.Dest.Write(prefix); err != nil {
+		return 0, err
+	}
+
+	if _, err := l.Config.Dest.Write(l.lengthMarker(p)); err != nil {
+		return 0, err
+	}
+
+	n, err = io.MultiWriter(l.Config.Src, l.Config.Dest).Write(p)
+
+	if err != nil {
+		return n, err
+	}
+
+	if _, err := l.Config.Dest.Write(l.suffix(l.Config.WriteSuffix, keepalive)); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+// count adds n to the bytes read or written in Counts, if the logger has one
+func (l *StreamLogger) count(read bool, n int) {
+	c := l.Config.Counts
+	if c == nil || n <= 0 {
+		return
+	}
+	if read {
+		atomic.AddInt64(&c.Read, int64(n))
+	} else {
+		atomic.AddInt64(&c.Written, int64(n))
+	}
+}
+
+// lengthMarker returns what's written in front of p if MarkLength is set. Only data that spans lines is marked, since a line that
+// isn't can't be mistaken for the start of the next read or write.
+func (l *StreamLogger) lengthMarker(p []byte) []byte {
+	if !l.Config.MarkLength || bytes.IndexByte(p, '\n') < 0 {
+		return nil
+	}
+	return []byte(fmt.Sprintf(lengthMarkerFormat, len(p)))
+}
+
+// suffix returns KeepaliveSuffix instead of suffix for keepalives, if it's set.
+func (l *StreamLogger) suffix(suffix []byte, keepalive bool) []byte {
+	if keepalive && len(l.Config.KeepaliveSuffix) > 0 {
+		return l.Config.KeepaliveSuffix
+	}
+	return suffix
+}
+
+// isKeepalive returns true if p is only whitespace, which is how XMPP keepalives are sent. Whether it is one depends on where
+// it was in the stream, which only the decoder knows.
+func isKeepalive(p []byte) bool {
+	return len(bytes.TrimSpace(p)) == 0
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// chunkReader returns one chunk per Read, like a connection that received them in separate packets
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func (r *chunkReader) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestStreamLoggerHoldsWhitespace(t *testing.T) {
+	var log bytes.Buffer
+	l := NewStreamLogger(&StreamLoggerConfig{
+		Src:             &chunkReader{chunks: []string{"<message>", "\n  ", "</message>", " "}},
+		Dest:            &log,
+		TimeFormat:      testLogTimeFormat,
+		ReadPrefix:      HopClientToProxy.logPrefix(false),
+		ReadSuffix:      []byte("\n"),
+		KeepaliveSuffix: []byte(keepaliveMarker + "\n"),
+		HoldWhitespace:  true,
+	})
+	buf := make([]byte, 64)
+	read := func() {
+		if _, err := l.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read()
+	read()
+	if strings.Contains(log.String(), "\n  ") {
+		t.Errorf("whitespace was logged before it was known whether it's a keepalive:\n%s", log.String())
+	}
+	// The whitespace was inside the message, since the next read follows without the decoder returning a keepalive
+	read()
+	read()
+	l.MarkKeepalive()
+	if got := strings.Count(log.String(), keepaliveMarker); got != 1 {
+		t.Errorf("got %d keepalives, want 1:\n%s", got, log.String())
+	}
+	if !strings.Contains(log.String(), " C->P \n  \n") || !strings.HasSuffix(log.String(), " C->P  "+keepaliveMarker+"\n") {
+		t.Errorf("only the whitespace between elements should be marked as a keepalive:\n%s", log.String())
+	}
+}
+
+func TestSessionLogsKeepalives(t *testing.T) {
+	addr := acceptOnce(t, func(c *testConn) {
+		serverLogin(c, `<stream:features/>`)
+		c.expect("</message>")
+		c.expect(" ")
+		c.expect(testStreamEnd)
+		c.send(testStreamEnd)
+	})
+	p, c, done := startTestProxy(t, &Config{Address: addr, Domain: "example.com", InspectStanzas: true, LogPath: t.TempDir()})
+	clientLogin(c, `<stream:features/>`)
+	// Pretty-printed XML split across packets, followed by a keepalive
+	for _, s := range []string{"<message id='m1'>", "\n  ", "<body>hi</body></message>", " "} {
+		c.send(s)
+	}
+	c.send(testStreamEnd)
+	c.expect(testStreamEnd)
+	c.Close()
+	if err := waitForRun(t, done); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, logType := range []string{"C2P", "P2S"} {
+		log, err := ioutil.ReadFile(p.LogName() + "." + logType + ".log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Count(string(log), keepaliveMarker); got != 1 {
+			t.Errorf("%s log has %d keepalives, want 1:\n%s", logType, got, log)
+		}
+	}
+	if p.keepalives.c2s.count != 1 {
+		t.Errorf("counted %d keepalives from the client, want 1", p.keepalives.c2s.count)
+	}
+}
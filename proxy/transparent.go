@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var errNotRedirected = errors.New("connection was not redirected to the proxy")
+
+// originalDestination returns the address that the client connected to before iptables redirected the connection to the proxy.
+// Connections redirected with REDIRECT carry their original destination in the conntrack entry, while TPROXY leaves it as the local address.
+func originalDestination(conn net.Conn) (*net.TCPAddr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, fmt.Errorf("can't read the original destination of a %T", conn)
+	}
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("can't read the original destination of a %s connection", conn.LocalAddr().Network())
+	}
+	dst, err := getOriginalDst(sc, local.IP.To4() == nil)
+	if err != nil {
+		// Without conntrack there's no NAT entry, which only leaves the local address to go on.
+		dst = local
+	}
+	// A connection made straight to the proxy would otherwise be dialed right back into it
+	if dst.IP.Equal(local.IP) && dst.Port == local.Port && isLocalIP(dst.IP) {
+		return nil, errNotRedirected
+	}
+	return dst, nil
+}
+
+// isLocalIP returns true if ip belongs to one of the host's interfaces
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
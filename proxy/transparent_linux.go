@@ -0,0 +1,56 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST from linux/netfilter_ipv4.h, which shares its value with IP6T_SO_ORIGINAL_DST.
+const soOriginalDst = 80
+
+// getOriginalDst reads the original destination of sc from its conntrack entry.
+// The sockaddr is read through the getsockopt helpers whose structs are large enough to hold it.
+func getOriginalDst(sc syscall.Conn, ipv6 bool) (*net.TCPAddr, error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var dst *net.TCPAddr
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv6 {
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			// sockaddr_in6
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, info.Addr.Addr[:])
+			dst = &net.TCPAddr{IP: ip, Port: int(ntohs(info.Addr.Port))}
+			return
+		}
+		mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		// sockaddr_in: family, port and address
+		b := mreq.Multiaddr
+		dst = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(b[2])<<8 | int(b[3])}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dst, sockErr
+}
+
+// ntohs converts a port read from a sockaddr in network byte order
+func ntohs(port uint16) uint16 {
+	b := (*[2]byte)(unsafe.Pointer(&port))
+	return uint16(b[0])<<8 | uint16(b[1])
+}
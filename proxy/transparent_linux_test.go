@@ -0,0 +1,23 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestGetOriginalDstWithoutConntrack(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(address, func(t *testing.T) {
+			_, conn := tcpPair(t, "tcp", address)
+			ipv6 := conn.LocalAddr().(*net.TCPAddr).IP.To4() == nil
+			// A connection that wasn't NATed has no conntrack entry to read, or no conntrack at all
+			if dst, err := getOriginalDst(conn.(syscall.Conn), ipv6); err == nil {
+				t.Errorf("got original destination %s for a connection that wasn't redirected", dst)
+			}
+		})
+	}
+}
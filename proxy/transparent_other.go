@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// getOriginalDst always fails outside of Linux, which leaves the local address of TPROXY-style interception.
+func getOriginalDst(sc syscall.Conn, ipv6 bool) (*net.TCPAddr, error) {
+	return nil, errors.New("SO_ORIGINAL_DST is only supported on Linux")
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a TCP connection made straight to a listener on network and address
+func tcpPair(t *testing.T, network, address string) (client, server net.Conn) {
+	t.Helper()
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Skipf("can't listen on %s: %s", address, err)
+	}
+	defer l.Close()
+	client, err = net.Dial(network, l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return client, server
+}
+
+func TestOriginalDestinationNotRedirected(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		t.Run(address, func(t *testing.T) {
+			_, conn := tcpPair(t, "tcp", address)
+			if dst, err := originalDestination(conn); err != errNotRedirected {
+				t.Errorf("got %v, %v, want errNotRedirected", dst, err)
+			}
+		})
+	}
+
+	client, _ := net.Pipe()
+	defer client.Close()
+	if _, err := originalDestination(client); err == nil || err == errNotRedirected {
+		t.Errorf("got %v for a pipe, want an error about the connection type", err)
+	}
+}
+
+func TestTransparentDirectConnection(t *testing.T) {
+	_, conn := tcpPair(t, "tcp", "127.0.0.1:0")
+	p, err := New(conn, nil, &Config{Address: "example.com:5222", Domain: "example.com", Transparent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.ServerAddr() != "" {
+		t.Errorf("got server address %q for a connection that wasn't redirected", p.ServerAddr())
+	}
+	// The proxy must not dial Address, or itself
+	if err := p.ConnectToServer(); err != errNotRedirected {
+		t.Errorf("ConnectToServer = %v, want errNotRedirected", err)
+	}
+}
+
+func TestIsLocalIP(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":   true,
+		"127.0.0.53":  true,
+		"::1":         true,
+		"0.0.0.0":     true,
+		"::":          true,
+		"192.0.2.1":   false, // TEST-NET-1
+		"2001:db8::1": false,
+	}
+	for ip, want := range tests {
+		if got := isLocalIP(net.ParseIP(ip)); got != want {
+			t.Errorf("isLocalIP(%s) = %t, want %t", ip, got, want)
+		}
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !isLocalIP(ipNet.IP) {
+			t.Errorf("isLocalIP(%s) = false for an interface address", ipNet.IP)
+		}
+	}
+}
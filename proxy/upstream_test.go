@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const tunnelGreeting = "<?xml version='1.0'?>"
+
+// socksRequest is what a socksStub was asked for
+type socksRequest struct {
+	method   byte
+	username string
+	password string
+	addrType byte
+	host     string
+	port     uint16
+}
+
+// socksStub is a SOCKS5 server that answers a single CONNECT with reply, and sends tunnelGreeting through the tunnel if it succeeded
+type socksStub struct {
+	authVersion  byte // Version of the authentication reply. 1 if zero.
+	authStatus   byte
+	replyVersion byte // Version of the CONNECT reply. 5 if zero.
+	reply        byte
+	requests     chan socksRequest
+}
+
+func (s *socksStub) start(t *testing.T) string {
+	s.requests = make(chan socksRequest, 1)
+	return acceptOnce(t, func(c *testConn) {
+		var req socksRequest
+		greeting := make([]byte, 3)
+		if _, err := io.ReadFull(c.r, greeting); err != nil {
+			return
+		}
+		req.method = greeting[2]
+		c.send(string([]byte{5, req.method}))
+		if req.method == 2 {
+			req.username, req.password = readSOCKSString(c, 1), readSOCKSString(c, 0)
+			version := s.authVersion
+			if version == 0 {
+				version = 1
+			}
+			c.send(string([]byte{version, s.authStatus}))
+			if s.authStatus != 0 {
+				return
+			}
+		}
+
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(c.r, header); err != nil {
+			return
+		}
+		req.addrType = header[3]
+		switch req.addrType {
+		case 1, 4:
+			ip := make([]byte, 4)
+			if req.addrType == 4 {
+				ip = make([]byte, 16)
+			}
+			io.ReadFull(c.r, ip)
+			req.host = net.IP(ip).String()
+		case 3:
+			req.host = readSOCKSString(c, 0)
+		}
+		port := make([]byte, 2)
+		io.ReadFull(c.r, port)
+		req.port = binary.BigEndian.Uint16(port)
+		s.requests <- req
+
+		version := s.replyVersion
+		if version == 0 {
+			version = 5
+		}
+		// The bound address is a domain, which is the longest form of the reply to read
+		c.send(string([]byte{version, s.reply, 0, 3, 4}) + "stub" + string([]byte{0x04, 0x38}))
+		if s.reply == 0 && version == 5 {
+			c.send(tunnelGreeting)
+			c.expect(testStreamEnd)
+		}
+	})
+}
+
+// readSOCKSString reads a string that is prefixed with its length, after skipping skip bytes
+func readSOCKSString(c *testConn, skip int) string {
+	b := make([]byte, skip+1)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return ""
+	}
+	s := make([]byte, b[skip])
+	io.ReadFull(c.r, s)
+	return string(s)
+}
+
+// expectTunnel checks that conn is connected to the stub's end of the tunnel
+func expectTunnel(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	greeting := make([]byte, len(tunnelGreeting))
+	if _, err := io.ReadFull(conn, greeting); err != nil || string(greeting) != tunnelGreeting {
+		t.Errorf("got %q from the tunnel: %v", greeting, err)
+	}
+	conn.Write([]byte(testStreamEnd))
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		addr    string
+		wantReq socksRequest
+	}{
+		{
+			name:    "domain without authentication",
+			addr:    "xmpp.example.com:5222",
+			wantReq: socksRequest{method: 0, addrType: 3, host: "xmpp.example.com", port: 5222},
+		},
+		{
+			name:    "IPv4 with username and password",
+			user:    "alice:secret@",
+			addr:    "192.0.2.1:5222",
+			wantReq: socksRequest{method: 2, username: "alice", password: "secret", addrType: 1, host: "192.0.2.1", port: 5222},
+		},
+		{
+			name:    "IPv6",
+			addr:    "[2001:db8::1]:5223",
+			wantReq: socksRequest{method: 0, addrType: 4, host: "2001:db8::1", port: 5223},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := &socksStub{}
+			upstream := "socks5://" + test.user + stub.start(t)
+			conn, err := dialUpstream(&net.Dialer{Timeout: testTimeout}, upstream, test.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if req := <-stub.requests; req != test.wantReq {
+				t.Errorf("got request %+v, want %+v", req, test.wantReq)
+			}
+			expectTunnel(t, conn)
+		})
+	}
+}
+
+func TestSOCKS5Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		stub    socksStub
+		wantErr string
+	}{
+		{name: "wrong password", user: "alice:wrong@", stub: socksStub{authStatus: 1}, wantErr: "SOCKS5 authentication failed"},
+		{name: "authentication version", user: "alice:secret@", stub: socksStub{authVersion: 5}, wantErr: "unknown SOCKS5 authentication version 5"},
+		{name: "reply version", stub: socksStub{replyVersion: 4}, wantErr: "not a SOCKS5 reply (version 4)"},
+		{name: "unassigned reply", stub: socksStub{reply: 9}, wantErr: "SOCKS5 reply 9"},
+	}
+	for code, reason := range socks5Replies {
+		tests = append(tests, struct {
+			name    string
+			user    string
+			stub    socksStub
+			wantErr string
+		}{name: reason, stub: socksStub{reply: code}, wantErr: reason})
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stub := test.stub
+			upstream := "socks5://" + test.user + stub.start(t)
+			conn, err := dialUpstream(&net.Dialer{Timeout: testTimeout}, upstream, "xmpp.example.com:5222")
+			if err == nil {
+				conn.Close()
+				t.Fatal("connected although the SOCKS5 server refused")
+			}
+			if !strings.HasSuffix(err.Error(), test.wantErr) {
+				t.Errorf("got %q, want it to end with %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+// httpProxyStub answers a single CONNECT with response. If the tunnel is opened, tunnelGreeting is sent in the same write as the
+// response, so that the client must not read past the end of the response.
+func httpProxyStub(t *testing.T, response string, requests chan<- string) string {
+	return acceptOnce(t, func(c *testConn) {
+		requests <- c.expect("\r\n\r\n")
+		if strings.Contains(response, " 200 ") {
+			c.send(response + tunnelGreeting)
+			c.expect(testStreamEnd)
+			return
+		}
+		c.send(response)
+	})
+}
+
+func TestHTTPConnect(t *testing.T) {
+	requests := make(chan string, 1)
+	upstream := "http://alice:secret@" + httpProxyStub(t, "HTTP/1.1 200 Connection established\r\nVia: stub\r\n\r\n", requests)
+	conn, err := dialUpstream(&net.Dialer{Timeout: testTimeout}, upstream, "xmpp.example.com:5222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := <-requests
+	if !strings.HasPrefix(req, "CONNECT xmpp.example.com:5222 HTTP/1.1\r\n") {
+		t.Errorf("got request %q", req)
+	}
+	if auth := "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")); !strings.Contains(req, auth) {
+		t.Errorf("request %q doesn't contain %q", req, auth)
+	}
+	expectTunnel(t, conn)
+}
+
+func TestHTTPConnectRefused(t *testing.T) {
+	requests := make(chan string, 1)
+	upstream := "http://" + httpProxyStub(t, "HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\nContent-Length: 0\r\n\r\n", requests)
+	conn, err := dialUpstream(&net.Dialer{Timeout: testTimeout}, upstream, "xmpp.example.com:5222")
+	if err == nil {
+		conn.Close()
+		t.Fatal("connected although the proxy refused")
+	}
+	if !strings.HasSuffix(err.Error(), "CONNECT failed: 407 Proxy Authentication Required") {
+		t.Errorf("got %q", err)
+	}
+	if req := <-requests; strings.Contains(req, "Proxy-Authorization") {
+		t.Errorf("request %q has credentials although none were configured", req)
+	}
+}
+
+func TestParseUpstreamProxy(t *testing.T) {
+	tests := []struct {
+		upstream string
+		wantHost string
+		wantErr  bool
+	}{
+		{upstream: "socks5://proxy.example.com", wantHost: "proxy.example.com:1080"},
+		{upstream: "http://proxy.example.com", wantHost: "proxy.example.com:80"},
+		{upstream: "http://[2001:db8::1]:3128", wantHost: "[2001:db8::1]:3128"},
+		{upstream: "https://proxy.example.com", wantErr: true},
+		{upstream: "socks5://", wantErr: true},
+	}
+	for _, test := range tests {
+		u, err := parseUpstreamProxy(test.upstream)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.upstream)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.upstream, err)
+			continue
+		}
+		if u.Host != test.wantHost {
+			t.Errorf("%s: got host %s, want %s", test.upstream, u.Host, test.wantHost)
+		}
+	}
+	if u, err := parseUpstreamProxy(""); u != nil || err != nil {
+		t.Errorf("an empty upstream proxy should dial directly, got %v %v", u, err)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/proxy"
+	"github.com/Jonchun/xmppeeker/xmpp"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// captureSuffixes are the suffixes of the two logs of every session
+var captureSuffixes = []string{".C2P.log", ".P2S.log"}
+
+// jidMatcher matches stanzas whose attribute attr is a JID matching the glob pattern. Patterns without a slash are matched against the bare JID.
+type jidMatcher struct {
+	attr    string
+	pattern string
+}
+
+func (m jidMatcher) Match(e xmpp.Element) bool {
+	jid, ok := xmpp.Attr(e, m.attr)
+	if !ok {
+		return false
+	}
+	if !strings.Contains(m.pattern, "/") {
+		jid = strings.SplitN(jid, "/", 2)[0]
+	}
+	ok, _ = path.Match(m.pattern, jid)
+	return ok
+}
+
+// searchHit is an element that matched a search, along with the stanzas related to it
+type searchHit struct {
+	Session  string       `json:"session"`
+	Time     time.Time    `json:"time"`
+	Hop      proxy.Hop    `json:"hop"`
+	Injected bool         `json:"injected,omitempty"`
+	XML      string       `json:"xml"`
+	Related  []*searchHit `json:"related,omitempty"`
+	element  xmpp.Element
+}
+
+func newSearchHit(session string, c proxy.CapturedElement) *searchHit {
+	return &searchHit{
+		Session:  session,
+		Time:     c.Time,
+		Hop:      c.Hop,
+		Injected: c.Injected,
+		XML:      strings.TrimSpace(c.Element.XML()),
+		element:  c.Element,
+	}
+}
+
+// stanzaID returns the id of e if it's a stanza, which is how requests and their responses are tied together
+func stanzaID(e xmpp.Element) string {
+	if !xmpp.IsStanzaName(e.Name()) {
+		return ""
+	}
+	id, _ := xmpp.Attr(e, "id")
+	return id
+}
+
+// runSearch implements `xmppeeker search`, which decodes the session logs and lists the elements that match the given filters.
+func runSearch(sugar *zap.SugaredLogger, args []string) int {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: xmppeeker search [flags] [session logs or directories...]\n\nLists the elements in the session logs that match every filter. Without paths, all logs in LogPath are searched.\n\n")
+		flags.PrintDefaults()
+	}
+	var name, space, stanzaType, to, from, id, text, since, until, hops, timeFormat string
+	var related, asJSON bool
+	flags.StringVar(&name, "name", "", "local name of the element e.g. iq, message or a")
+	flags.StringVar(&space, "ns", "", "namespace of the element or one of its children e.g. jabber:iq:roster")
+	flags.StringVar(&stanzaType, "type", "", "type of the stanza e.g. get, result or groupchat")
+	flags.StringVar(&to, "to", "", "bare JID the stanza is addressed to, or full JID if it contains a slash. Glob patterns like '*@example.com' work.")
+	flags.StringVar(&from, "from", "", "bare JID the stanza is from, or full JID if it contains a slash. Glob patterns work.")
+	flags.StringVar(&id, "id", "", "id of the stanza")
+	flags.StringVar(&text, "text", "", "regular expression matched against the text content of the element")
+	flags.StringVar(&since, "since", "", "only elements logged after this RFC 3339 time, date, or duration ago e.g. 48h")
+	flags.StringVar(&until, "until", "", "only elements logged before this RFC 3339 time, date, or duration ago e.g. 24h")
+	flags.StringVar(&hops, "hops", "C->P,S->P", "comma separated hops to search, out of C->P, P->C, S->P and P->S, or 'all'. By default, elements are searched as the client and server sent them.")
+	flags.BoolVar(&related, "related", true, "print the stanzas sharing the id of each match below it, e.g. the result of an iq")
+	flags.StringVar(&timeFormat, "time-format", "", "LogTimeFormat the logs were written with. Defaults to the one in the config if no paths are given, and to the default LogTimeFormat otherwise.")
+	flags.BoolVar(&asJSON, "json", false, "print the matches as JSON lines")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return ExitOK
+	} else if err != nil {
+		return ExitUsage
+	}
+
+	var matchers []xmpp.Matcher
+	if name != "" {
+		matchers = append(matchers, xmpp.LocalMatcher(name))
+	}
+	if space != "" {
+		matchers = append(matchers, xmpp.Or(xmpp.SpaceMatcher(space), xmpp.ChildMatcher{Space: space}))
+	}
+	if stanzaType != "" {
+		matchers = append(matchers, xmpp.TypeMatcher(stanzaType))
+	}
+	for attr, pattern := range map[string]string{"to": to, "from": from} {
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			fmt.Fprintf(os.Stderr, "-%s: %s\n", attr, err)
+			return ExitUsage
+		}
+		matchers = append(matchers, jidMatcher{attr: attr, pattern: pattern})
+	}
+	if id != "" {
+		matchers = append(matchers, xmpp.AttrMatcher{Name: "id", Value: id})
+	}
+	if text != "" {
+		re, err := regexp.Compile(text)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "-text:", err)
+			return ExitUsage
+		}
+		matchers = append(matchers, xmpp.TextRegexMatcher{Regexp: re})
+	}
+	matcher := xmpp.And(matchers...)
+
+	now := time.Now()
+	sinceTime, err := parseTime(since, now)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-since:", err)
+		return ExitUsage
+	}
+	untilTime, err := parseTime(until, now)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "-until:", err)
+		return ExitUsage
+	}
+
+	searched := map[proxy.Hop]bool{}
+	if hops == "all" {
+		hops = strings.Join([]string{string(proxy.HopClientToProxy), string(proxy.HopProxyToClient), string(proxy.HopServerToProxy), string(proxy.HopProxyToServer)}, ",")
+	}
+	for _, hop := range strings.Split(hops, ",") {
+		switch h := proxy.Hop(strings.TrimSpace(hop)); h {
+		case proxy.HopClientToProxy, proxy.HopProxyToClient, proxy.HopServerToProxy, proxy.HopProxyToServer:
+			searched[h] = true
+		default:
+			fmt.Fprintf(os.Stderr, "-hops: unknown hop %q\n", hop)
+			return ExitUsage
+		}
+	}
+
+	paths := flags.Args()
+	if len(paths) == 0 {
+		configureViper(sugar)
+		paths = []string{viper.GetString("LogPath")}
+		if timeFormat == "" {
+			timeFormat = viper.GetString("LogTimeFormat")
+		}
+	}
+	if timeFormat == "" {
+		timeFormat = DefaultLogTimeFormat
+	}
+	sessions, err := findSessions(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to find session logs:", err)
+		return ExitFatal
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	for _, session := range sessions {
+		captured, err := proxy.ReadCapture(session, timeFormat)
+		if err != nil {
+			// Whatever was decoded before the error is still searched
+			fmt.Fprintln(os.Stderr, "failed to read session logs:", err)
+		}
+		for _, hit := range searchCapture(session, captured, matcher, sinceTime, untilTime, searched, related) {
+			if asJSON {
+				encoder.Encode(hit)
+			} else {
+				printSearchHit(os.Stdout, hit, timeFormat)
+			}
+		}
+	}
+	return ExitOK
+}
+
+// findSessions returns the log names of the sessions whose logs are at or below paths, sorted and without duplicates.
+// Links are resolved, so that a session filed by JID isn't searched again through LogPath/by-jid.
+func findSessions(paths []string) ([]string, error) {
+	found := map[string]bool{}
+	add := func(file string) error {
+		for _, suffix := range captureSuffixes {
+			if strings.HasSuffix(file, suffix) {
+				resolved, err := filepath.EvalSymlinks(file)
+				if err != nil {
+					return err
+				}
+				found[strings.TrimSuffix(resolved, suffix)] = true
+			}
+		}
+		return nil
+	}
+	for _, root := range paths {
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if err := add(root); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		err = filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			return add(file)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sessions := make([]string, 0, len(found))
+	for session := range found {
+		sessions = append(sessions, session)
+	}
+	sort.Strings(sessions)
+	return sessions, nil
+}
+
+// searchCapture returns the elements of a session that match, with the stanzas related to each. Related stanzas that match
+// on their own are only listed as matches.
+func searchCapture(session string, captured []proxy.CapturedElement, matcher xmpp.Matcher, since, until time.Time, hops map[proxy.Hop]bool, related bool) []*searchHit {
+	var hits []*searchHit
+	matched := map[int]bool{}
+	for i, c := range captured {
+		if !hops[c.Hop] || (!since.IsZero() && c.Time.Before(since)) || (!until.IsZero() && c.Time.After(until)) {
+			continue
+		}
+		if !matcher.Match(c.Element) {
+			continue
+		}
+		matched[i] = true
+		hits = append(hits, newSearchHit(session, c))
+	}
+	if !related {
+		return hits
+	}
+
+	byID := map[string][]int{}
+	for i, c := range captured {
+		if id := stanzaID(c.Element); id != "" && hops[c.Hop] {
+			byID[id] = append(byID[id], i)
+		}
+	}
+	for _, hit := range hits {
+		id := stanzaID(hit.element)
+		for _, i := range byID[id] {
+			c := captured[i]
+			if !matched[i] && c.Element.Name().Local == hit.element.Name().Local {
+				hit.Related = append(hit.Related, newSearchHit(session, c))
+			}
+		}
+	}
+	return hits
+}
+
+func printSearchHit(out io.Writer, hit *searchHit, timeFormat string) {
+	fmt.Fprintf(out, "%s %s %s %s%s\n", hit.Session, hit.Time.Format(timeFormat), hit.Hop, injectedLabel(hit.Injected), hit.XML)
+	for _, r := range hit.Related {
+		fmt.Fprintf(out, "    %s %s %s%s\n", r.Time.Format(timeFormat), r.Hop, injectedLabel(r.Injected), r.XML)
+	}
+}
+
+func injectedLabel(injected bool) string {
+	if injected {
+		return "[injected] "
+	}
+	return ""
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Jonchun/xmppeeker/proxy"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+)
+
+// sessionFilter selects records of the session index. Empty fields match every record.
+type sessionFilter struct {
+	id       string // Prefix of the session id
+	jid      string // Glob matched against the bare JID, or the full JID if it contains a slash
+	clientIP string // Glob matched against the client IP
+	backend  string // Glob matched against the backend address
+	reason   string // Substring of the close reason
+	since    time.Time
+	until    time.Time
+	tls      string // "yes" or "no"
+}
+
+func (f *sessionFilter) match(r proxy.SessionRecord) bool {
+	if f.id != "" && !strings.HasPrefix(r.ID, f.id) {
+		return false
+	}
+	if f.jid != "" {
+		jid := r.JID
+		if strings.Contains(f.jid, "/") {
+			jid += "/" + r.Resource
+		}
+		if ok, _ := path.Match(f.jid, jid); !ok {
+			return false
+		}
+	}
+	if f.clientIP != "" {
+		host, _, err := net.SplitHostPort(r.ClientAddr)
+		if err != nil {
+			host = r.ClientAddr
+		}
+		if ok, _ := path.Match(f.clientIP, host); !ok {
+			return false
+		}
+	}
+	if f.backend != "" {
+		if ok, _ := path.Match(f.backend, r.BackendAddr); !ok {
+			return false
+		}
+	}
+	if f.reason != "" && !strings.Contains(r.CloseReason, f.reason) {
+		return false
+	}
+	// A session matches a time window if it was running at any point of it
+	if !f.since.IsZero() && r.End.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && r.Start.After(f.until) {
+		return false
+	}
+	switch f.tls {
+	case "yes":
+		return r.ClientTLS != nil
+	case "no":
+		return r.ClientTLS == nil
+	}
+	return true
+}
+
+// parseTime accepts an RFC 3339 time, a date, or a duration that is counted back from now e.g. 36h
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration, a date nor an RFC 3339 time", s)
+}
+
+// runSessions implements `xmppeeker sessions`, which lists the sessions in the session index that match the given filters.
+func runSessions(sugar *zap.SugaredLogger, args []string) int {
+	flags := flag.NewFlagSet("sessions", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: xmppeeker sessions [flags]\n\nLists the sessions recorded in %s, oldest first.\n\n", filepath.Join("$LogPath", proxy.SessionIndexFile))
+		flags.PrintDefaults()
+	}
+	var f sessionFilter
+	var since, until, index string
+	var asJSON bool
+	flags.StringVar(&f.id, "id", "", "session id or a prefix of it")
+	flags.StringVar(&f.jid, "jid", "", "bare JID, or full JID if it contains a slash. Glob patterns like '*@example.com' work.")
+	flags.StringVar(&f.clientIP, "ip", "", "client IP. Glob patterns like '10.0.*' work.")
+	flags.StringVar(&f.backend, "backend", "", "backend host:port. Glob patterns work.")
+	flags.StringVar(&f.reason, "reason", "", "only sessions whose close reason contains this")
+	flags.StringVar(&since, "since", "", "only sessions running after this RFC 3339 time, date, or duration ago e.g. 48h")
+	flags.StringVar(&until, "until", "", "only sessions running before this RFC 3339 time, date, or duration ago e.g. 24h")
+	flags.StringVar(&f.tls, "tls", "", "'yes' or 'no' to only list sessions whose client did or didn't use TLS")
+	flags.StringVar(&index, "index", "", "path of the session index. Defaults to the one in LogPath of the config.")
+	flags.BoolVar(&asJSON, "json", false, "print the matching records as JSON lines")
+	if err := flags.Parse(args); err == flag.ErrHelp {
+		return ExitOK
+	} else if err != nil {
+		return ExitUsage
+	}
+	if f.tls != "" && f.tls != "yes" && f.tls != "no" {
+		fmt.Fprintln(os.Stderr, "-tls must be 'yes' or 'no'")
+		return ExitUsage
+	}
+	now := time.Now()
+	var err error
+	if f.since, err = parseTime(since, now); err != nil {
+		fmt.Fprintln(os.Stderr, "-since:", err)
+		return ExitUsage
+	}
+	if f.until, err = parseTime(until, now); err != nil {
+		fmt.Fprintln(os.Stderr, "-until:", err)
+		return ExitUsage
+	}
+
+	if index == "" {
+		configureViper(sugar)
+		index = filepath.Join(viper.GetString("LogPath"), proxy.SessionIndexFile)
+	}
+	records, err := proxy.ReadSessionIndex(index)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to read session index:", err)
+		return ExitFatal
+	}
+	var matched []proxy.SessionRecord
+	for _, r := range records {
+		if f.match(r) {
+			matched = append(matched, r)
+		}
+	}
+	if asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		for _, r := range matched {
+			encoder.Encode(r)
+		}
+		return ExitOK
+	}
+	printSessions(os.Stdout, matched)
+	return ExitOK
+}
+
+func printSessions(out io.Writer, records []proxy.SessionRecord) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SESSION\tSTART\tDURATION\tJID\tCLIENT\tBACKEND\tC->S\tS->C\tCLIENT TLS\tSERVER TLS\tCLOSED BY\tREASON\tLOG")
+	for _, r := range records {
+		jid := r.JID
+		if r.Resource != "" {
+			jid += "/" + r.Resource
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			r.ID,
+			r.Start.Local().Format("2006-01-02 15:04:05"),
+			r.End.Sub(r.Start).Round(time.Second),
+			orDash(jid),
+			r.ClientAddr,
+			orDash(r.BackendAddr),
+			r.BytesFromClient,
+			r.BytesFromServer,
+			formatTLS(r.ClientTLS),
+			formatTLS(r.ServerTLS),
+			r.ClosedBy,
+			r.CloseReason,
+			orDash(r.LogName),
+		)
+	}
+	w.Flush()
+}
+
+func formatTLS(info *proxy.TLSInfo) string {
+	if info == nil {
+		return "-"
+	}
+	return info.Version + " " + info.CipherSuite
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -14,34 +14,88 @@ const (
 )
 
 // A Decoder represents an XMPP parser reading a particular input stream. The parser uses xml.Decoder under the hood.
+// Every Element returned by a Decoder keeps the exact input bytes it was decoded from, so that it can be forwarded unchanged.
 type Decoder struct {
-	Header       string
+	Header     string
+	Limits     Limits  // Checked while an element is read. The zero value doesn't limit anything.
+	scope      nsScope // Namespace context of the innermost open element
+	nsStack    stack   // Namespace contexts of the parents of the innermost open element
+	reader     io.Reader
+	recorder   *recorder
+	xmlDecoder *xml.Decoder
+	skipped    int64 // Bytes consumed from recorder without going through xmlDecoder
+}
+
+// nsScope is the namespace context that an element is decoded in.
+// prefixMap is shared between scopes until an element declares a prefix of its own, so it must not be modified in place.
+type nsScope struct {
 	defaultSpace string
-	nsStack      stack
 	prefixMap    map[string]string
-	reader       io.Reader
-	xmlDecoder   *xml.Decoder
+}
+
+// declare returns the scope of an element with the attributes attrs inside of s.
+func (s nsScope) declare(attrs []xml.Attr) nsScope {
+	copied := false
+	for _, a := range attrs {
+		switch {
+		case a.Name.Space == xmlnsPrefix:
+			if !copied {
+				prefixMap := make(map[string]string, len(s.prefixMap)+1)
+				for prefix, space := range s.prefixMap {
+					prefixMap[prefix] = space
+				}
+				s.prefixMap = prefixMap
+				copied = true
+			}
+			s.prefixMap[a.Name.Local] = a.Value
+		case a.Name.Space == "" && a.Name.Local == xmlnsPrefix:
+			s.defaultSpace = a.Value
+		}
+	}
+	return s
 }
 
 // NewDecoder creates a new Decoder reading from r.
 func NewDecoder(r io.Reader) *Decoder {
+	rec := &recorder{r: r}
 	d := Decoder{
-		Header:       "",
-		defaultSpace: "",
-		nsStack:      stack{},
-		prefixMap:    make(map[string]string),
-		reader:       r,
-		xmlDecoder:   xml.NewDecoder(r),
+		Header:     "",
+		scope:      nsScope{},
+		nsStack:    stack{},
+		reader:     r,
+		recorder:   rec,
+		xmlDecoder: xml.NewDecoder(rec),
 	}
 	return &d
 }
 
+// Reset discards the state of d so that it decodes a new stream from r. Limits are kept.
+// This is needed when a stream restarts on a new connection e.g. after StartTLS. To restart on the same connection, pass
+// io.MultiReader(d.Buffered(), r) so that input that was already read isn't lost. A stream header that arrives on the same
+// stream resets the namespace context by itself, so a restart after SASL success doesn't need Reset.
+func (d *Decoder) Reset(r io.Reader) {
+	limits := d.Limits
+	*d = *NewDecoder(r)
+	d.Limits = limits
+}
+
 // NextElement returns the next Element in the stream.
+// The input consumed by the call is available from the Element's XML(). Whitespace between elements is returned as a
+// Whitespace element of its own.
 func (d *Decoder) NextElement() (Element, error) {
-	buf := new(bytes.Buffer)
-	encoder := xml.NewEncoder(buf)
-	stopName := xml.Name{}
+	start := d.inputOffset()
+	d.recorder.discard(start)
+	d.recorder.max = d.Limits.MaxElementSize
+	if ws, err := d.readWhitespace(); err != nil {
+		return nil, err
+	} else if ws > 0 {
+		return Whitespace{xml: d.recorder.slice(start, start+ws)}, nil
+	}
+	header := ""
+	tb := treeBuilder{}
+	depth := 0
 	for {
+		offset := d.inputOffset()
 		t, err := d.xmlDecoder.RawToken()
 		if err != nil {
 			return nil, err
@@ -49,23 +103,21 @@ func (d *Decoder) NextElement() (Element, error) {
 		if t == nil {
 			return nil, nil
 		}
+		if err := checkLimit(LimitElementSize, d.Limits.MaxElementSize, d.inputOffset()-start); err != nil {
+			return nil, err
+		}
 		switch t1 := t.(type) {
 		case xml.StartElement:
-			rawTokenCopy := t1.Copy()
-			encodeRawToken(encoder, t1)
-			// Parse xmlns definitions first
-			for _, a := range t1.Attr {
-				if a.Name.Space == xmlnsPrefix {
-					d.prefixMap[a.Name.Local] = a.Value
-				}
-				if a.Name.Space == "" && a.Name.Local == xmlnsPrefix {
-					d.defaultSpace = a.Value
-				}
+			if err := d.Limits.checkStartElement(t1); err != nil {
+				return nil, err
 			}
+			rawTokenCopy := t1.Copy()
+			// Parse xmlns definitions first, since they apply to the element they are declared on
+			d.nsStack.Push(d.scope)
+			d.scope = d.scope.declare(t1.Attr)
 
 			// Translate the name of the element
 			d.translate(&t1.Name, true)
-			d.nsStack.Push(t1.Name.Space)
 
 			// Translate the name of all of the attributes
 			for i := range t1.Attr {
@@ -74,49 +126,95 @@ func (d *Decoder) NextElement() (Element, error) {
 
 			// Check if this is the start of a stream
 			if t1.Name.Space == NSStream && t1.Name.Local == "stream" {
-				encoder.Flush()
+				// A restarted stream doesn't inherit anything from the stream it replaces
+				d.nsStack = stack{}
+				d.nsStack.Push(nsScope{})
+				d.scope = nsScope{}.declare(t1.Attr)
 				stream := NewStream(rawTokenCopy)
+				stream.header = header
+				stream.raw = d.recorder.slice(start, d.inputOffset())
 				return stream, nil
 			}
 
-			// If stopName is empty, we populate it
-			if stopName == (xml.Name{}) {
-				stopName = t1.Name
+			depth++
+			if err := checkLimit(LimitDepth, int64(d.Limits.MaxDepth), int64(depth)); err != nil {
+				return nil, err
 			}
+			tb.StartElement(t1)
 		case xml.EndElement:
-			encodeRawToken(encoder, t1)
+			// The end tag is translated in the scope of its element before going back to the parent's scope
 			d.translate(&t1.Name, true)
-			d.nsStack.Pop()
-			v := d.nsStack.Peek()
-			defaultSpace := ""
-			if v != nil {
-				defaultSpace = v.(string)
+			if v := d.nsStack.Pop(); v != nil {
+				d.scope = v.(nsScope)
 			}
-			d.defaultSpace = defaultSpace
 
-			// Check if end of stream
-			if t1.Name.Space == NSStream && t1.Name.Local == "stream" {
-				return StreamEnd{}, nil
+			// Outside of an element, the only end tag that can appear is the end of the stream
+			if depth == 0 {
+				if t1.Name.Space == NSStream && t1.Name.Local == "stream" {
+					return StreamEnd{xml: d.recorder.slice(start, d.inputOffset())}, nil
+				}
+				return nil, &xml.SyntaxError{Msg: fmt.Sprintf("unexpected end element </%s>", t1.Name.Local)}
 			}
-			// If the current token is the end element of the start element, we return.
-			if stopName == t1.Name {
-				encoder.Flush()
-				ge := NewGenericElement(t1.Name, buf.String())
-				return ge, nil
+			tb.EndElement()
+			depth--
+			// If the current token is the end of the element that was started first, we return.
+			if depth == 0 {
+				end := d.inputOffset()
+				ge := NewGenericElement(t1.Name, d.recorder.slice(start, end))
+				ge.tree = tb.root
+				ge.start, ge.end = start, end
+				return newStanza(ge), nil
 			}
 		case xml.ProcInst:
 			// This is to catch and save the XML Header from the raw tokens being processed by the decoder e.g.
 			// <?xml version="1.0" encoding="UTF-8"?>
-			encodeRawToken(encoder, t1)
 			if t1.Target == xmlPrefix {
-				encoder.Flush()
-				d.Header = buf.String()
-				buf.Reset()
+				header = d.recorder.slice(offset, d.inputOffset())
+				d.Header = header
+			}
+		case xml.CharData:
+			tb.CharData(t1)
+		}
+	}
+}
+
+// Buffered returns a reader of the input that has been read from the underlying reader but not decoded yet.
+// It's meant for handing a stream over to something else after the last element has been decoded.
+func (d *Decoder) Buffered() io.Reader {
+	return bytes.NewReader(d.recorder.buf[d.recorder.pos:])
+}
+
+// inputOffset returns the input offset of the next byte that will be decoded.
+// It's only accurate between tokens, which is fine since xml.Decoder doesn't hold back any input after a tag.
+func (d *Decoder) inputOffset() int64 {
+	return d.xmlDecoder.InputOffset() + d.skipped
+}
+
+// readWhitespace consumes the whitespace in front of the next element and returns how many bytes it consumed.
+// It stops once nothing more is buffered, so that a keepalive is returned when it arrives instead of when the next element does.
+func (d *Decoder) readWhitespace() (int64, error) {
+	n := int64(0)
+	for n == 0 || d.recorder.buffered() > 0 {
+		b, err := d.recorder.peek()
+		if err != nil {
+			if n > 0 {
+				// The error is returned again by the next call
+				break
 			}
-		default:
-			encodeRawToken(encoder, t1)
+			return 0, err
+		}
+		if !isSpace(b) {
+			break
 		}
+		d.recorder.ReadByte()
+		n++
 	}
+	d.skipped += n
+	return n, nil
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
 }
 
 // translate implements XML name spaces as described by
@@ -134,10 +232,10 @@ func (d *Decoder) translate(n *xml.Name, isElementName bool) {
 	case n.Space == "" && n.Local == xmlnsPrefix:
 		return
 	}
-	if v, ok := d.prefixMap[n.Space]; ok {
+	if v, ok := d.scope.prefixMap[n.Space]; ok {
 		n.Space = v
 	} else if n.Space == "" {
-		n.Space = d.defaultSpace
+		n.Space = d.scope.defaultSpace
 	}
 }
 
@@ -147,12 +245,12 @@ func encodeRawToken(e *xml.Encoder, t xml.Token) {
 	case xml.StartElement:
 		attrs := make([]xml.Attr, 10)
 		for _, attr := range token.Attr {
-			if attr.Name.Space == xmlnsPrefix {
-				// hack to prevent golang's xml encoder from escaping the xmlns attr
+			if attr.Name.Space != "" {
+				// hack to prevent golang's xml encoder from escaping the xmlns attr and from declaring new namespaces for prefixed attrs like xml:lang
 				attrCopy := xml.Attr{
 					Name: xml.Name{
 						Space: "",
-						Local: fmt.Sprintf("%s:%s", xmlnsPrefix, attr.Name.Local),
+						Local: fmt.Sprintf("%s:%s", attr.Name.Space, attr.Name.Local),
 					},
 					Value: attr.Value,
 				}
@@ -0,0 +1,201 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	testClientHeader = `<stream:stream xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>`
+	testServerHeader = `<stream:stream xmlns='jabber:server' xmlns:stream='http://etherx.jabber.org/streams' xmlns:db='jabber:server:dialback' version='1.0'>`
+)
+
+// renderNames renders the resolved names of e and its descendants e.g. {jabber:client}iq[{jabber:iq:roster}query]
+func renderNames(e Element) string {
+	var sb strings.Builder
+	var render func(name xml.Name, children []*Node)
+	render = func(name xml.Name, children []*Node) {
+		sb.WriteString("{" + name.Space + "}" + name.Local)
+		if len(children) == 0 {
+			return
+		}
+		sb.WriteString("[")
+		for i, c := range children {
+			if i > 0 {
+				sb.WriteString(" ")
+			}
+			render(c.Name, c.Children)
+		}
+		sb.WriteString("]")
+	}
+	var children []*Node
+	if t, ok := e.(interface{ Tree() *Node }); ok && t.Tree() != nil {
+		children = t.Tree().Children
+	}
+	render(e.Name(), children)
+	return sb.String()
+}
+
+// decodeAll returns the rendered names of every element in the input, leaving out whitespace
+func decodeAll(t *testing.T, d *Decoder) []string {
+	t.Helper()
+	var names []string
+	for {
+		e, err := d.NextElement()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("NextElement: %s", err)
+		}
+		if _, ok := e.(Whitespace); ok {
+			continue
+		}
+		names = append(names, renderNames(e))
+	}
+}
+
+func TestDecoderNamespaces(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{
+			name:  "stream features",
+			input: testClientHeader + `<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`,
+			want: []string{
+				"{http://etherx.jabber.org/streams}stream",
+				"{http://etherx.jabber.org/streams}features[{urn:ietf:params:xml:ns:xmpp-sasl}mechanisms[{urn:ietf:params:xml:ns:xmpp-sasl}mechanism] {urn:ietf:params:xml:ns:xmpp-bind}bind]",
+			},
+		},
+		{
+			name:  "stream error",
+			input: testClientHeader + `<stream:error><host-unknown xmlns='urn:ietf:params:xml:ns:xmpp-streams'/></stream:error></stream:stream>`,
+			want: []string{
+				"{http://etherx.jabber.org/streams}stream",
+				"{http://etherx.jabber.org/streams}error[{urn:ietf:params:xml:ns:xmpp-streams}host-unknown]",
+				"{http://etherx.jabber.org/streams}streamend",
+			},
+		},
+		{
+			name:  "dialback result",
+			input: testServerHeader + `<db:result from='a.example' to='b.example'>key</db:result><db:verify from='a.example' to='b.example' id='1'>key</db:verify>`,
+			want: []string{
+				"{http://etherx.jabber.org/streams}stream",
+				"{jabber:server:dialback}result",
+				"{jabber:server:dialback}verify",
+			},
+		},
+		{
+			name:  "stanzas in the stream's default namespace",
+			input: testServerHeader + `<message from='a@a.example' to='b@b.example'><body>hi</body></message>`,
+			want: []string{
+				"{http://etherx.jabber.org/streams}stream",
+				"{jabber:server}message[{jabber:server}body]",
+			},
+		},
+		{
+			name:  "prefixed siblings",
+			input: testClientHeader + `<p:one xmlns:p='urn:one'><p:a/></p:one><p:two xmlns:p='urn:two'><p:b/></p:two><p:three/>`,
+			want: []string{
+				"{http://etherx.jabber.org/streams}stream",
+				"{urn:one}one[{urn:one}a]",
+				"{urn:two}two[{urn:two}b]",
+				// The prefix isn't declared for the third sibling, so it's kept as the namespace
+				"{p}three",
+			},
+		},
+		{
+			name:  "prefix declared on a child",
+			input: testClientHeader + `<message><x:a xmlns:x='urn:x'/><x:b/></message><message><x:a/></message>`,
+			want: []string{
+				"{http://etherx.jabber.org/streams}stream",
+				"{jabber:client}message[{urn:x}a {x}b]",
+				"{jabber:client}message[{x}a]",
+			},
+		},
+		{
+			name:  "default namespace after an element closes",
+			input: testClientHeader + `<iq type='result'><query xmlns='jabber:iq:roster'><item jid='a@example.com'/></query><other/></iq><message/>`,
+			want: []string{
+				"{http://etherx.jabber.org/streams}stream",
+				"{jabber:client}iq[{jabber:iq:roster}query[{jabber:iq:roster}item] {jabber:client}other]",
+				"{jabber:client}message",
+			},
+		},
+		{
+			name:  "stream restart",
+			input: testServerHeader + `<db:result/>` + testClientHeader + `<db:result/><message/>`,
+			want: []string{
+				"{http://etherx.jabber.org/streams}stream",
+				"{jabber:server:dialback}result",
+				"{http://etherx.jabber.org/streams}stream",
+				// Nothing is inherited from the stream that was restarted
+				"{db}result",
+				"{jabber:client}message",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := decodeAll(t, NewDecoder(strings.NewReader(test.input)))
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestDecoderKeepsInput(t *testing.T) {
+	elements := []string{
+		`<?xml version='1.0'?>` + testClientHeader,
+		` `,
+		`<stream:features><starttls xmlns="urn:ietf:params:xml:ns:xmpp-tls"/></stream:features>`,
+		`<message to='a@example.com'><body>a &amp; b</body></message>`,
+		`</stream:stream>`,
+	}
+	d := NewDecoder(strings.NewReader(strings.Join(elements, "")))
+	for _, want := range elements {
+		e, err := d.NextElement()
+		if err != nil {
+			t.Fatalf("NextElement: %s", err)
+		}
+		if e.XML() != want {
+			t.Errorf("got %q, want %q", e.XML(), want)
+		}
+	}
+}
+
+func TestDecoderReset(t *testing.T) {
+	d := NewDecoder(strings.NewReader(testServerHeader + `<db:result/><p:a xmlns:p='urn:p'>`))
+	d.Limits = Limits{MaxDepth: 2}
+	for i := 0; i < 2; i++ {
+		if _, err := d.NextElement(); err != nil {
+			t.Fatalf("NextElement: %s", err)
+		}
+	}
+
+	// The old stream is abandoned in the middle of an element, like a connection that's upgraded to TLS
+	d.Reset(strings.NewReader(testClientHeader + `<db:result/><p:a/><message><body/></message>`))
+	got := decodeAll(t, d)
+	want := []string{
+		"{http://etherx.jabber.org/streams}stream",
+		"{db}result",
+		"{p}a",
+		"{jabber:client}message[{jabber:client}body]",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	d.Reset(strings.NewReader(testClientHeader + `<message><a><b/></a></message>`))
+	d.NextElement()
+	if _, err := d.NextElement(); err == nil {
+		t.Error("limits were not kept after Reset")
+	} else if limitErr, ok := err.(*LimitError); !ok || limitErr.Limit != LimitDepth {
+		t.Errorf("got %v, want a depth LimitError", err)
+	}
+}
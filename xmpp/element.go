@@ -11,9 +11,13 @@ type Element interface {
 }
 
 // A GenericElement is used to represent any generic XMPP Element by storing their raw XML as a string as well as their resolved xml.Name.
+// Elements returned by a Decoder also carry their parsed Node tree, and their XML is the exact bytes they were decoded from.
 type GenericElement struct {
-	name xml.Name
-	xml  string
+	name  xml.Name
+	xml   string
+	tree  *Node
+	start int64
+	end   int64
 }
 
 // NewGenericElement creates a GenericElement given a name and the raw XML for an XMPP Element.
@@ -32,3 +36,14 @@ func (e GenericElement) Name() xml.Name {
 func (e GenericElement) XML() string {
 	return e.xml
 }
+
+// Tree returns the parsed Node tree of the element, or nil if the element wasn't created by a Decoder.
+func (e GenericElement) Tree() *Node {
+	return e.tree
+}
+
+// InputRange returns the input offsets that XML() was read from within the stream the element was decoded from.
+// Both are 0 if the element wasn't created by a Decoder.
+func (e GenericElement) InputRange() (start, end int64) {
+	return e.start, e.end
+}
@@ -0,0 +1,66 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+)
+
+// Limits bounds the resources a Decoder spends on a single element. A zero field means there is no limit.
+type Limits struct {
+	MaxElementSize int64 // Bytes in an element, including any whitespace before it
+	MaxDepth       int   // Nesting depth of an element. Children of the stream have a depth of 1.
+	MaxAttrs       int   // Attributes on a single tag, including namespace declarations
+	MaxNameLength  int   // Bytes in an element or attribute name, including the prefix
+}
+
+// Names of the limits reported in a LimitError
+const (
+	LimitElementSize = "element size"
+	LimitDepth       = "depth"
+	LimitAttrs       = "attributes"
+	LimitNameLength  = "name length"
+)
+
+// LimitError is returned by a Decoder when the input exceeds one of its Limits.
+// The Decoder can't be used any further once a LimitError has been returned.
+type LimitError struct {
+	Limit string // One of the Limit constants
+	Max   int64  // The configured limit
+	Value int64  // The value that exceeded it
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s of %d exceeds limit of %d", e.Limit, e.Value, e.Max)
+}
+
+// checkLimit returns a LimitError if max is set and value exceeds it.
+func checkLimit(limit string, max, value int64) error {
+	if max > 0 && value > max {
+		return &LimitError{Limit: limit, Max: max, Value: value}
+	}
+	return nil
+}
+
+// checkStartElement checks the tag se against the attribute and name length limits. se must not have been translated yet.
+func (l Limits) checkStartElement(se xml.StartElement) error {
+	if err := checkLimit(LimitAttrs, int64(l.MaxAttrs), int64(len(se.Attr))); err != nil {
+		return err
+	}
+	if err := checkLimit(LimitNameLength, int64(l.MaxNameLength), nameLength(se.Name)); err != nil {
+		return err
+	}
+	for _, a := range se.Attr {
+		if err := checkLimit(LimitNameLength, int64(l.MaxNameLength), nameLength(a.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nameLength returns the length of an untranslated name as it appears in the input.
+func nameLength(n xml.Name) int64 {
+	if n.Space == "" {
+		return int64(len(n.Local))
+	}
+	return int64(len(n.Space) + 1 + len(n.Local))
+}
@@ -0,0 +1,124 @@
+package xmpp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecoderLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		raw    string // Decoded after testClientHeader, which is read without limits
+		limit  string // Empty if raw should be decoded
+		value  int64
+	}{
+		{
+			name:   "size",
+			limits: Limits{MaxElementSize: 22},
+			raw:    `<message>abcd</message>`,
+			limit:  LimitElementSize,
+			value:  23,
+		},
+		{
+			name:   "size at the limit",
+			limits: Limits{MaxElementSize: 23},
+			raw:    `<message>abcd</message>`,
+		},
+		{
+			name:   "size of a single huge token",
+			limits: Limits{MaxElementSize: 100},
+			raw:    `<message><body>` + strings.Repeat("a", 1<<20) + `</body></message>`,
+			limit:  LimitElementSize,
+		},
+		{
+			name:   "depth at the limit",
+			limits: Limits{MaxDepth: 2},
+			raw:    `<message><body>hi</body></message>`,
+		},
+		{
+			name:   "depth",
+			limits: Limits{MaxDepth: 2},
+			raw:    `<iq><query xmlns='jabber:iq:roster'><item/></query></iq>`,
+			limit:  LimitDepth,
+			value:  3,
+		},
+		{
+			name:   "namespace declarations count as attributes",
+			limits: Limits{MaxAttrs: 3},
+			raw:    `<message to='a' from='b' xmlns:p='urn:p'><p:x/></message>`,
+		},
+		{
+			name:   "attributes",
+			limits: Limits{MaxAttrs: 3},
+			raw:    `<message><x xmlns='urn:x' xmlns:p='urn:p' a='1' p:b='2'/></message>`,
+			limit:  LimitAttrs,
+			value:  4,
+		},
+		{
+			name:   "element name with prefix",
+			limits: Limits{MaxNameLength: 8},
+			raw:    `<message><pre:abcd xmlns:pre='urn:p'/></message>`,
+			limit:  LimitNameLength,
+			value:  8 + 1,
+		},
+		{
+			name:   "attribute name",
+			limits: Limits{MaxNameLength: 8},
+			raw:    `<message abcdefghi='1'/>`,
+			limit:  LimitNameLength,
+			value:  9,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(testClientHeader + test.raw))
+			if _, err := d.NextElement(); err != nil {
+				t.Fatalf("stream header: %s", err)
+			}
+			d.Limits = test.limits
+			e, err := d.NextElement()
+			if test.limit == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if e.XML() != test.raw {
+					t.Errorf("got %q, want %q", e.XML(), test.raw)
+				}
+				return
+			}
+			limitErr, ok := err.(*LimitError)
+			if !ok || limitErr.Limit != test.limit {
+				t.Fatalf("got %v, want a %s LimitError", err, test.limit)
+			}
+			if test.value != 0 && limitErr.Value != test.value {
+				t.Errorf("got value %d, want %d", limitErr.Value, test.value)
+			}
+			// Reading stops before a huge token is buffered in full
+			if limitErr.Limit == LimitElementSize && limitErr.Value > limitErr.Max+recorderChunkSize {
+				t.Errorf("read %d bytes with a limit of %d", limitErr.Value, limitErr.Max)
+			}
+		})
+	}
+}
+
+func TestDecoderLimitsStreamHeader(t *testing.T) {
+	// The header is counted with the prefixed name stream:stream and its three attributes
+	d := NewDecoder(strings.NewReader(testClientHeader))
+	d.Limits = Limits{MaxNameLength: len("stream:stream"), MaxAttrs: 3}
+	if _, err := d.NextElement(); err != nil {
+		t.Fatal(err)
+	}
+	d = NewDecoder(strings.NewReader(testClientHeader))
+	d.Limits = Limits{MaxAttrs: 2}
+	if _, err := d.NextElement(); err == nil {
+		t.Error("stream header with too many attributes was decoded")
+	}
+}
+
+func TestLimitError(t *testing.T) {
+	err := &LimitError{Limit: LimitDepth, Max: 2, Value: 3}
+	if got, want := err.Error(), "depth of 3 exceeds limit of 2"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
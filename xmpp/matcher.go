@@ -1,6 +1,9 @@
 package xmpp
 
-import "encoding/xml"
+import (
+	"encoding/xml"
+	"regexp"
+)
 
 // Matcher.Match returns true if the Element meets the conditions of the Matcher
 type Matcher interface {
@@ -25,9 +28,148 @@ func (m SpaceMatcher) Match(e Element) bool {
 	return e.Name().Space == string(m)
 }
 
+// LocalMatcher is a Matcher that checks to see if e.Name.Local is equal to itself.
+type LocalMatcher string
+
+func (m LocalMatcher) Match(e Element) bool {
+	return e.Name().Local == string(m)
+}
+
 // AllMatcher is a Matcher that matches any Element.
 type AllMatcher struct{}
 
 func (m AllMatcher) Match(e Element) bool {
 	return true
 }
+
+// MessageMatcher is a Matcher that matches any *Message.
+type MessageMatcher struct{}
+
+func (m MessageMatcher) Match(e Element) bool {
+	_, ok := e.(*Message)
+	return ok
+}
+
+// PresenceMatcher is a Matcher that matches any *Presence.
+type PresenceMatcher struct{}
+
+func (m PresenceMatcher) Match(e Element) bool {
+	_, ok := e.(*Presence)
+	return ok
+}
+
+// IQMatcher is a Matcher that matches any *IQ.
+type IQMatcher struct{}
+
+func (m IQMatcher) Match(e Element) bool {
+	_, ok := e.(*IQ)
+	return ok
+}
+
+// WhitespaceMatcher is a Matcher that matches the Whitespace between elements.
+type WhitespaceMatcher struct{}
+
+func (m WhitespaceMatcher) Match(e Element) bool {
+	_, ok := e.(Whitespace)
+	return ok
+}
+
+// AndMatcher is a Matcher that matches an Element if all of its Matchers match.
+type AndMatcher []Matcher
+
+// And returns a Matcher that matches an Element if all of matchers match.
+func And(matchers ...Matcher) AndMatcher {
+	return AndMatcher(matchers)
+}
+
+func (m AndMatcher) Match(e Element) bool {
+	for _, matcher := range m {
+		if !matcher.Match(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// OrMatcher is a Matcher that matches an Element if any of its Matchers match.
+type OrMatcher []Matcher
+
+// Or returns a Matcher that matches an Element if any of matchers match.
+func Or(matchers ...Matcher) OrMatcher {
+	return OrMatcher(matchers)
+}
+
+func (m OrMatcher) Match(e Element) bool {
+	for _, matcher := range m {
+		if matcher.Match(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotMatcher is a Matcher that matches an Element if its Matcher doesn't.
+type NotMatcher struct {
+	Matcher Matcher
+}
+
+// Not returns a Matcher that matches an Element if matcher doesn't.
+func Not(matcher Matcher) NotMatcher {
+	return NotMatcher{Matcher: matcher}
+}
+
+func (m NotMatcher) Match(e Element) bool {
+	return !m.Matcher.Match(e)
+}
+
+// AttrMatcher is a Matcher that checks to see if the unprefixed attribute Name on the root of an Element equals Value.
+type AttrMatcher struct {
+	Name  string
+	Value string
+}
+
+func (m AttrMatcher) Match(e Element) bool {
+	v, ok := Attr(e, m.Name)
+	return ok && v == m.Value
+}
+
+// AttrRegexMatcher is a Matcher that checks to see if the unprefixed attribute Name on the root of an Element matches Regexp.
+type AttrRegexMatcher struct {
+	Name   string
+	Regexp *regexp.Regexp
+}
+
+func (m AttrRegexMatcher) Match(e Element) bool {
+	v, ok := Attr(e, m.Name)
+	return ok && m.Regexp.MatchString(v)
+}
+
+// ChildMatcher is a Matcher that checks to see if an Element has a direct child with the same name as itself.
+// An empty Space or Local matches any namespace or local name.
+type ChildMatcher xml.Name
+
+func (m ChildMatcher) Match(e Element) bool {
+	for _, child := range Children(e) {
+		if (m.Space == "" || m.Space == child.Space) && (m.Local == "" || m.Local == child.Local) {
+			return true
+		}
+	}
+	return false
+}
+
+// TextRegexMatcher is a Matcher that checks to see if the text content of an Element matches Regexp.
+type TextRegexMatcher struct {
+	Regexp *regexp.Regexp
+}
+
+func (m TextRegexMatcher) Match(e Element) bool {
+	return m.Regexp.MatchString(Text(e))
+}
+
+// TypeMatcher is a Matcher that checks to see if an Element is a stanza with a type attribute equal to itself.
+type TypeMatcher string
+
+func (m TypeMatcher) Match(e Element) bool {
+	s, ok := e.(interface{ stanza() *Stanza })
+	return ok && s.stanza().Type == string(m)
+}
@@ -0,0 +1,94 @@
+package xmpp
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestMatchers(t *testing.T) {
+	message := decodeInStream(t, testClientHeader, `<message to='b@example.com' type='chat'><body>hello world</body><active xmlns='http://jabber.org/protocol/chatstates'/></message>`)
+	iq := decodeInStream(t, testClientHeader, `<iq type='get' id='p1'><ping xmlns='urn:xmpp:ping'/></iq>`)
+	sm := decodeInStream(t, testClientHeader, `<a xmlns='urn:xmpp:sm:3' h='3'/>`)
+	whitespace := Whitespace{xml: "\n"}
+
+	tests := []struct {
+		name    string
+		matcher Matcher
+		matches []Element
+		misses  []Element
+	}{
+		{name: "message", matcher: MessageMatcher{}, matches: []Element{message}, misses: []Element{iq, sm, whitespace}},
+		{name: "iq", matcher: IQMatcher{}, matches: []Element{iq}, misses: []Element{message, sm}},
+		{name: "whitespace", matcher: WhitespaceMatcher{}, matches: []Element{whitespace}, misses: []Element{message, sm}},
+		{
+			name:    "attribute",
+			matcher: AttrMatcher{Name: "to", Value: "b@example.com"},
+			matches: []Element{message},
+			misses:  []Element{iq, sm, whitespace},
+		},
+		{
+			name:    "attribute regex",
+			matcher: AttrRegexMatcher{Name: "h", Regexp: regexp.MustCompile(`^\d+$`)},
+			matches: []Element{sm},
+			misses:  []Element{message, iq},
+		},
+		{
+			name:    "child of a namespace",
+			matcher: ChildMatcher{Space: "urn:xmpp:ping"},
+			matches: []Element{iq},
+			misses:  []Element{message, sm, whitespace},
+		},
+		{
+			name:    "child in the stanza namespace",
+			matcher: ChildMatcher{Space: NSClient, Local: "body"},
+			matches: []Element{message},
+			misses:  []Element{iq},
+		},
+		{
+			name:    "child of another namespace",
+			matcher: ChildMatcher{Space: "urn:example", Local: "body"},
+			misses:  []Element{message},
+		},
+		{
+			name:    "text",
+			matcher: TextRegexMatcher{Regexp: regexp.MustCompile(`hello`)},
+			matches: []Element{message},
+			misses:  []Element{iq, sm},
+		},
+		{name: "type", matcher: TypeMatcher("get"), matches: []Element{iq}, misses: []Element{message, sm}},
+		// <a/> has no type attribute as a stanza would
+		{name: "empty type", matcher: TypeMatcher(""), misses: []Element{message, sm, whitespace}},
+		{
+			name:    "and",
+			matcher: And(MessageMatcher{}, TypeMatcher("chat"), ChildMatcher{Local: "active"}),
+			matches: []Element{message},
+			misses:  []Element{iq, sm},
+		},
+		{name: "empty and", matcher: And(), matches: []Element{message, whitespace}},
+		{
+			name:    "or",
+			matcher: Or(IQMatcher{}, SpaceMatcher("urn:xmpp:sm:3")),
+			matches: []Element{iq, sm},
+			misses:  []Element{message, whitespace},
+		},
+		{name: "empty or", matcher: Or(), misses: []Element{message, whitespace}},
+		{
+			name:    "not",
+			matcher: Not(Or(WhitespaceMatcher{}, MessageMatcher{})),
+			matches: []Element{iq, sm},
+			misses:  []Element{message, whitespace},
+		},
+	}
+	for _, test := range tests {
+		for _, e := range test.matches {
+			if !test.matcher.Match(e) {
+				t.Errorf("%s: didn't match %s", test.name, e.XML())
+			}
+		}
+		for _, e := range test.misses {
+			if test.matcher.Match(e) {
+				t.Errorf("%s: matched %q", test.name, e.XML())
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// Node is a lightweight tree representation of an XML element with namespace-resolved names.
+// Namespace declarations are not included in Attr since they are already applied to the names.
+type Node struct {
+	Name     xml.Name
+	Attr     []xml.Attr
+	Children []*Node
+	Text     string // Character data directly inside the element. Text of children is not included.
+}
+
+// AttrValue returns the value of the unprefixed attribute named local, and whether it was present.
+func (n *Node) AttrValue(local string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Name.Space == "" && a.Name.Local == local {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Child returns the first direct child of n selected by name, or nil if there is none.
+// name is a local name, which matches in any namespace, or a local name qualified as "{namespace}local". See Qualify.
+func (n *Node) Child(name string) *Node {
+	for _, c := range n.Children {
+		if c.matches(name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Qualify returns the path segment selecting elements named local in the namespace space e.g. "{jabber:iq:roster}query".
+func Qualify(space, local string) string {
+	return "{" + space + "}" + local
+}
+
+// matches reports whether n is selected by a single path segment.
+func (n *Node) matches(segment string) bool {
+	if segment == "*" {
+		return true
+	}
+	if strings.HasPrefix(segment, "{") {
+		if i := strings.Index(segment, "}"); i >= 0 {
+			return n.Name.Space == segment[1:i] && (segment[i+1:] == "*" || n.Name.Local == segment[i+1:])
+		}
+	}
+	return n.Name.Local == segment
+}
+
+// splitPath splits path into its segments at every slash outside of a namespace qualifier, since namespaces are often URLs.
+func splitPath(path string) []string {
+	var segments []string
+	start, inQualifier := 0, false
+	for i, r := range path {
+		switch {
+		case r == '{':
+			inQualifier = true
+		case r == '}':
+			inQualifier = false
+		case r == '/' && !inQualifier:
+			segments = append(segments, path[start:i])
+			start = i + 1
+		}
+	}
+	return append(segments, path[start:])
+}
+
+// InnerText returns the character data of n and all of its children, concatenated in document order.
+func (n *Node) InnerText() string {
+	var sb strings.Builder
+	n.writeInnerText(&sb)
+	return sb.String()
+}
+
+func (n *Node) writeInnerText(sb *strings.Builder) {
+	sb.WriteString(n.Text)
+	for _, c := range n.Children {
+		c.writeInnerText(sb)
+	}
+}
+
+// Find returns the descendants of n selected by path, a slash separated list of names relative to n e.g. "query/item".
+// A segment is a local name, which matches in any namespace, or a qualified name such as "{jabber:iq:roster}query" that only
+// matches in the given namespace. A "*" segment matches any element, "{namespace}*" any element in namespace.
+// An empty path selects n itself.
+func (n *Node) Find(path string) []*Node {
+	nodes := []*Node{n}
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nodes
+	}
+	for _, segment := range splitPath(path) {
+		var next []*Node
+		for _, node := range nodes {
+			for _, c := range node.Children {
+				if c.matches(segment) {
+					next = append(next, c)
+				}
+			}
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// Query returns the values selected by path. If path ends with @name, the values of that attribute are returned
+// e.g. "query/item@jid" returns the jid of every roster item. Otherwise the text of every node selected by Find is returned.
+func (n *Node) Query(path string) []string {
+	var values []string
+	attr := ""
+	// Only an @ after the last namespace qualifier starts the attribute name
+	if i := strings.LastIndex(path, "@"); i > strings.LastIndex(path, "}") {
+		path, attr = path[:i], path[i+1:]
+	}
+	for _, node := range n.Find(path) {
+		if attr == "" {
+			values = append(values, node.Text)
+		} else if v, ok := node.AttrValue(attr); ok {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// treeBuilder assembles a Node tree from the translated tokens of an element while it is being decoded.
+type treeBuilder struct {
+	root  *Node
+	stack []*Node
+}
+
+func (b *treeBuilder) StartElement(se xml.StartElement) {
+	n := &Node{Name: se.Name}
+	for _, a := range se.Attr {
+		if a.Name.Space == xmlnsPrefix || (a.Name.Space == "" && a.Name.Local == xmlnsPrefix) {
+			continue
+		}
+		n.Attr = append(n.Attr, a)
+	}
+	if len(b.stack) == 0 {
+		b.root = n
+	} else {
+		parent := b.stack[len(b.stack)-1]
+		parent.Children = append(parent.Children, n)
+	}
+	b.stack = append(b.stack, n)
+}
+
+func (b *treeBuilder) EndElement() {
+	if len(b.stack) > 0 {
+		b.stack = b.stack[:len(b.stack)-1]
+	}
+}
+
+func (b *treeBuilder) CharData(cd xml.CharData) {
+	if len(b.stack) > 0 {
+		b.stack[len(b.stack)-1].Text += string(cd)
+	}
+}
+
+// Tree returns the Node tree of e. Elements that were decoded carry their tree already. For anything else, e.XML() is parsed.
+// nil is returned if e has no tree and its XML can't be parsed.
+func Tree(e Element) *Node {
+	if t, ok := e.(interface{ Tree() *Node }); ok {
+		if n := t.Tree(); n != nil {
+			return n
+		}
+	}
+	decoded, err := NewDecoder(strings.NewReader(e.XML())).NextElement()
+	if err != nil {
+		return nil
+	}
+	if t, ok := decoded.(interface{ Tree() *Node }); ok {
+		return t.Tree()
+	}
+	return nil
+}
+
+// Query returns the values selected by path in the tree of e. See Node.Query.
+func Query(e Element, path string) []string {
+	n := Tree(e)
+	if n == nil {
+		return nil
+	}
+	return n.Query(path)
+}
@@ -0,0 +1,80 @@
+package xmpp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testDiscoItems = `<iq xmlns='jabber:client' type='result' id='d1'>` +
+	`<query xmlns='http://jabber.org/protocol/disco#items'><item jid='a@example.com'/><item jid='b@example.com'/></query>` +
+	`<query xmlns='jabber:iq:roster'><item jid='c@example.com'/></query>` +
+	`</iq>`
+
+func TestNodeQueryNamespaces(t *testing.T) {
+	e, err := NewDecoder(strings.NewReader(testDiscoItems)).NextElement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{path: "query/item@jid", want: []string{"a@example.com", "b@example.com", "c@example.com"}},
+		{path: "{http://jabber.org/protocol/disco#items}query/item@jid", want: []string{"a@example.com", "b@example.com"}},
+		{path: "{jabber:iq:roster}query/{jabber:iq:roster}item@jid", want: []string{"c@example.com"}},
+		{path: "{jabber:iq:roster}*/*@jid", want: []string{"c@example.com"}},
+		{path: "{jabber:client}query/item@jid"},
+	}
+	for _, test := range tests {
+		if got := Query(e, test.path); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Query(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+
+	root := Tree(e)
+	if c := root.Child(Qualify("jabber:iq:roster", "query")); c == nil || c.Name.Space != "jabber:iq:roster" {
+		t.Errorf("Child picked %v", c)
+	}
+	if c := root.Child("query"); c == nil || c.Name.Space != "http://jabber.org/protocol/disco#items" {
+		t.Errorf("Child picked %v, want the first query", c)
+	}
+}
+
+func TestStanzaErrorNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		condition string // Empty if no stanza error should be read
+	}{
+		{
+			name:      "stanza error",
+			raw:       `<iq xmlns='jabber:client' type='error' id='e1'><error type='cancel'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>`,
+			condition: "item-not-found",
+		},
+		{
+			name: "payload error",
+			raw:  `<message xmlns='jabber:client'><error xmlns='urn:example:payload'><item-not-found xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></message>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := NewDecoder(strings.NewReader(test.raw)).NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, ok := e.(interface{ stanza() *Stanza })
+			if !ok {
+				t.Fatalf("decoded %T, want a stanza", e)
+			}
+			stanzaErr := s.stanza().Error
+			if test.condition == "" {
+				if stanzaErr != nil {
+					t.Errorf("read stanza error %+v from a payload", stanzaErr)
+				}
+			} else if stanzaErr == nil || stanzaErr.Condition != test.condition {
+				t.Errorf("got stanza error %+v, want %s", stanzaErr, test.condition)
+			}
+		})
+	}
+}
@@ -6,4 +6,15 @@ const (
 	NSClient = "jabber:client"
 	NSServer = "jabber:server"
 	NSSASL   = "urn:ietf:params:xml:ns:xmpp-sasl"
+	NSSM     = "urn:xmpp:sm:3"
+	NSSASLCB = "urn:xmpp:sasl-cb:0"
+	NSBind   = "urn:ietf:params:xml:ns:xmpp-bind"
+
+	NSStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	NSStreams = "urn:ietf:params:xml:ns:xmpp-streams"
+
+	NSCompress        = "http://jabber.org/protocol/compress"
+	NSCompressFeature = "http://jabber.org/features/compress"
+
+	NSComponentAccept = "jabber:component:accept"
 )
@@ -0,0 +1,87 @@
+package xmpp
+
+import "io"
+
+// recorderChunkSize is how much is read from the underlying reader at a time
+const recorderChunkSize = 4096
+
+// recorder buffers the input of a Decoder and keeps a copy of everything read since the last discard, so that the exact
+// input bytes of an element can be recovered after xml.Decoder has tokenized them.
+// recorder implements io.ByteReader, so xml.Decoder reads from it directly instead of adding its own buffer. This lets the
+// Decoder look at what is buffered between elements.
+type recorder struct {
+	r      io.Reader
+	buf    []byte // Bytes read from r, starting at the input offset offset
+	pos    int    // How much of buf has been consumed
+	offset int64  // Input offset of buf[0]
+	max    int64  // If set, reading fails once more than max bytes have been consumed since the last discard
+	chunk  []byte
+	err    error // Error returned by r, which is reported once buf has been consumed
+}
+
+// fill makes sure that at least one unconsumed byte is buffered.
+func (r *recorder) fill() error {
+	for r.pos == len(r.buf) {
+		if r.err != nil {
+			return r.err
+		}
+		// Checking before reading more bounds memory even when a single token is huge.
+		if err := checkLimit(LimitElementSize, r.max, int64(r.pos)); err != nil {
+			return err
+		}
+		if r.chunk == nil {
+			r.chunk = make([]byte, recorderChunkSize)
+		}
+		n, err := r.r.Read(r.chunk)
+		r.buf = append(r.buf, r.chunk[:n]...)
+		r.err = err
+	}
+	return nil
+}
+
+func (r *recorder) Read(p []byte) (int, error) {
+	if err := r.fill(); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.buf[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+func (r *recorder) ReadByte() (byte, error) {
+	if err := r.fill(); err != nil {
+		return 0, err
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// peek returns the next byte without consuming it.
+func (r *recorder) peek() (byte, error) {
+	if err := r.fill(); err != nil {
+		return 0, err
+	}
+	return r.buf[r.pos], nil
+}
+
+// buffered returns how many bytes can be consumed without reading from r.
+func (r *recorder) buffered() int {
+	return len(r.buf) - r.pos
+}
+
+// slice returns a copy of the recorded bytes between the input offsets start and end.
+func (r *recorder) slice(start, end int64) string {
+	return string(r.buf[start-r.offset : end-r.offset])
+}
+
+// discard forgets the recorded bytes before the input offset, which must not be past what has been consumed.
+func (r *recorder) discard(offset int64) {
+	n := int(offset - r.offset)
+	if n <= 0 {
+		return
+	}
+	r.buf = append(r.buf[:0], r.buf[n:]...)
+	r.pos -= n
+	r.offset = offset
+}
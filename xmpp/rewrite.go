@@ -0,0 +1,163 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// Attr returns the value of the unprefixed attribute named local on the root of e, and whether it was present.
+func Attr(e Element, local string) (string, bool) {
+	n := Tree(e)
+	if n == nil {
+		return "", false
+	}
+	return n.AttrValue(local)
+}
+
+// WithAttr returns a copy of e with the unprefixed attribute named local on its root set to value.
+// The attribute is added if it doesn't exist yet.
+func WithAttr(e Element, local string, value string) (Element, error) {
+	buf := new(bytes.Buffer)
+	encoder := xml.NewEncoder(buf)
+	d := xml.NewDecoder(strings.NewReader(e.XML()))
+	found := false
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if se, ok := t.(xml.StartElement); ok && !found {
+			found = true
+			se = se.Copy()
+			replaced := false
+			for i, a := range se.Attr {
+				if a.Name.Space == "" && a.Name.Local == local {
+					se.Attr[i].Value = value
+					replaced = true
+				}
+			}
+			if !replaced {
+				se.Attr = append(se.Attr, xml.Attr{Name: xml.Name{Local: local}, Value: value})
+			}
+			t = se
+		}
+		encodeRawToken(encoder, t)
+	}
+	encoder.Flush()
+	return newElement(e.Name(), buf.String()), nil
+}
+
+// WithoutChildren returns a copy of e without the direct children for which drop returns true.
+// The name passed to drop uses the namespace declared by the child's own xmlns attribute, or its raw prefix if it has none.
+func WithoutChildren(e Element, drop func(name xml.Name) bool) (Element, error) {
+	buf := new(bytes.Buffer)
+	encoder := xml.NewEncoder(buf)
+	d := xml.NewDecoder(strings.NewReader(e.XML()))
+	depth, skipUntil := 0, -1
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t1 := t.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 && skipUntil < 0 {
+				if drop(xml.Name{Space: elementSpace(t1), Local: t1.Name.Local}) {
+					skipUntil = depth
+				}
+			}
+		case xml.EndElement:
+			depth--
+			if skipUntil > depth {
+				skipUntil = -1
+				continue
+			}
+		}
+		if skipUntil < 0 {
+			encodeRawToken(encoder, t)
+		}
+	}
+	encoder.Flush()
+	return newElement(e.Name(), buf.String()), nil
+}
+
+// WithChild returns a copy of e with the raw XML of child inserted as its first child.
+func WithChild(e Element, child string) (Element, error) {
+	buf := new(bytes.Buffer)
+	encoder := xml.NewEncoder(buf)
+	d := xml.NewDecoder(strings.NewReader(e.XML()))
+	inserted := false
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		encodeRawToken(encoder, t)
+		if _, ok := t.(xml.StartElement); ok && !inserted {
+			inserted = true
+			// The encoder has already closed the start tag, so the child can follow it as is
+			encoder.Flush()
+			buf.WriteString(child)
+		}
+	}
+	encoder.Flush()
+	return newElement(e.Name(), buf.String()), nil
+}
+
+// declaredSpace returns the namespace declared by the xmlns attribute of se, or the raw prefix of se if it has none.
+func declaredSpace(se xml.StartElement) string {
+	for _, a := range se.Attr {
+		if a.Name.Space == "" && a.Name.Local == xmlnsPrefix {
+			return a.Value
+		}
+	}
+	return se.Name.Space
+}
+
+// elementSpace returns the namespace of se as far as its own attributes declare it, i.e. xmlns for an unprefixed name and
+// xmlns:prefix for a prefixed one. The raw prefix of se is returned if it declares neither.
+func elementSpace(se xml.StartElement) string {
+	if se.Name.Space == "" {
+		return declaredSpace(se)
+	}
+	for _, a := range se.Attr {
+		if a.Name.Space == xmlnsPrefix && a.Name.Local == se.Name.Space {
+			return a.Value
+		}
+	}
+	return se.Name.Space
+}
+
+// Text returns the character data of e and all of its children, concatenated.
+func Text(e Element) string {
+	n := Tree(e)
+	if n == nil {
+		return ""
+	}
+	return n.InnerText()
+}
+
+// Children returns the names of the direct children of e.
+func Children(e Element) []xml.Name {
+	n := Tree(e)
+	if n == nil {
+		return nil
+	}
+	children := make([]xml.Name, 0, len(n.Children))
+	for _, c := range n.Children {
+		children = append(children, c.Name)
+	}
+	return children
+}
@@ -3,10 +3,16 @@ package xmpp
 import "fmt"
 
 // A Router contains Routes which are used to process XMPP Elements via different handlers.
+// Observers see every Element before it is routed, and Middleware wraps the routing of every Element.
 type Router struct {
-	routes []Route
+	routes     []Route
+	observers  []Handler
+	middleware []Middleware
 }
 
+// Middleware wraps a Handler with another Handler e.g. to log or rewrite elements before passing them on.
+type Middleware func(Handler) Handler
+
 // NewRouter returns an empty Router
 func NewRouter() *Router {
 	return &Router{}
@@ -22,16 +28,57 @@ func (r *Router) AddRoutes(routes ...Route) {
 	r.routes = append(r.routes, routes...)
 }
 
+// Use adds Middleware that wraps the routing of every Element. It runs once per call to Route, around the Route that matches
+// and any Routes that it passes the Element on to, so an Element it rewrites is matched as rewritten. Middleware added first is
+// the outermost.
+func (r *Router) Use(middleware ...Middleware) {
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// Observe adds Handlers that are called with every Element before it is routed. Observers can't change the Element, and an
+// error from an observer is returned by Route without routing the Element.
+func (r *Router) Observe(observers ...Handler) {
+	r.observers = append(r.observers, observers...)
+}
+
 // Route takes an element and executes its relevant Handler if a match is found.
 func (r *Router) Route(e Element) error {
-	for _, route := range r.routes {
-		if route.Match(e) {
-			if route.Handler() == nil {
-				return fmt.Errorf("found route but handler doesn't exist: %s", e.XML())
-			}
-			return route.Handler().HandleElement(e)
+	for _, o := range r.observers {
+		if err := o.HandleElement(e); err != nil {
+			return err
 		}
 	}
+	var h Handler = HandlerFunc(func(e Element) error {
+		return r.routeFrom(e, 0)
+	})
+	for j := len(r.middleware) - 1; j >= 0; j-- {
+		h = r.middleware[j](h)
+	}
+	return h.HandleElement(e)
+}
+
+// routeFrom executes the Handler of the first Route at or after index i that matches e.
+func (r *Router) routeFrom(e Element, i int) error {
+	for ; i < len(r.routes); i++ {
+		route := r.routes[i]
+		if !route.Match(e) {
+			continue
+		}
+		h := route.Handler()
+		if h == nil {
+			return fmt.Errorf("found route but handler doesn't exist: %s", e.XML())
+		}
+		if ch, ok := h.(ChainHandler); ok {
+			following := i + 1
+			next := HandlerFunc(func(e Element) error {
+				return r.routeFrom(e, following)
+			})
+			h = HandlerFunc(func(e Element) error {
+				return ch.HandleElementNext(e, next)
+			})
+		}
+		return h.HandleElement(e)
+	}
 	return fmt.Errorf("no routes were found that match: %s", e.XML())
 }
 
@@ -92,3 +139,23 @@ type HandlerFunc func(e Element) error
 func (f HandlerFunc) HandleElement(e Element) error {
 	return f(e)
 }
+
+// A ChainHandler is a Handler that can pass an Element on to the Routes after its own by calling next. The Element passed to
+// next doesn't have to be the one that was handled, so a ChainHandler can rewrite elements for the Routes that follow it.
+type ChainHandler interface {
+	Handler
+	HandleElementNext(e Element, next Handler) error
+}
+
+// The ChainHandlerFunc type is an adapter to allow the use of ordinary functions as ChainHandlers.
+type ChainHandlerFunc func(e Element, next Handler) error
+
+// HandleElement calls f with a next Handler that does nothing, for when f is used outside of a Router.
+func (f ChainHandlerFunc) HandleElement(e Element) error {
+	return f(e, HandlerFunc(func(Element) error { return nil }))
+}
+
+// HandleElementNext calls f(e, next)
+func (f ChainHandlerFunc) HandleElementNext(e Element, next Handler) error {
+	return f(e, next)
+}
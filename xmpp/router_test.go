@@ -0,0 +1,93 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+// recordingRouter returns a Router whose observer, middleware and Routes append what they see to calls
+func recordingRouter(calls *[]string) *Router {
+	r := NewRouter()
+	r.Observe(HandlerFunc(func(e Element) error {
+		*calls = append(*calls, "observer")
+		return nil
+	}))
+	for _, name := range []string{"outer", "inner"} {
+		name := name
+		r.Use(func(next Handler) Handler {
+			return HandlerFunc(func(e Element) error {
+				*calls = append(*calls, name+" before")
+				err := next.HandleElement(e)
+				*calls = append(*calls, name+" after")
+				return err
+			})
+		})
+	}
+	return r
+}
+
+func TestRouterMiddleware(t *testing.T) {
+	var calls []string
+	r := recordingRouter(&calls)
+	chained := NewRoute()
+	chained.AddMatcher(AllMatcher{})
+	chained.SetHandler(ChainHandlerFunc(func(e Element, next Handler) error {
+		calls = append(calls, "chained "+e.Name().Local)
+		return next.HandleElement(e)
+	}))
+	last := NewRoute()
+	last.AddMatcher(AllMatcher{})
+	last.SetHandler(HandlerFunc(func(e Element) error {
+		calls = append(calls, "last "+e.Name().Local)
+		return nil
+	}))
+	r.AddRoutes(chained, chained, last)
+
+	if err := r.Route(NewGenericElement(xml.Name{Local: "a"}, "<a/>")); err != nil {
+		t.Fatal(err)
+	}
+	// The middleware wraps the whole chain once, however many Routes the element passes through
+	want := []string{"observer", "outer before", "inner before", "chained a", "chained a", "last a", "inner after", "outer after"}
+	if strings.Join(calls, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+}
+
+func TestRouterMiddlewareRewrites(t *testing.T) {
+	r := NewRouter()
+	r.Use(func(next Handler) Handler {
+		return HandlerFunc(func(e Element) error {
+			return next.HandleElement(NewGenericElement(xml.Name{Local: "b"}, "<b/>"))
+		})
+	})
+	var routed string
+	for _, local := range []string{"a", "b"} {
+		local := local
+		route := NewRoute()
+		route.AddMatcher(LocalMatcher(local))
+		route.SetHandler(HandlerFunc(func(e Element) error {
+			routed = local
+			return nil
+		}))
+		r.AddRoute(route)
+	}
+	if err := r.Route(NewGenericElement(xml.Name{Local: "a"}, "<a/>")); err != nil {
+		t.Fatal(err)
+	}
+	if routed != "b" {
+		t.Errorf("element was routed to %q, want the route matching the rewritten element", routed)
+	}
+}
+
+func TestRouterNoRoute(t *testing.T) {
+	var calls []string
+	r := recordingRouter(&calls)
+	if err := r.Route(NewGenericElement(xml.Name{Local: "a"}, "<a/>")); err == nil {
+		t.Error("routing an element that matches no route succeeded")
+	}
+	want := []string{"observer", "outer before", "inner before", "inner after", "outer after"}
+	if strings.Join(calls, ", ") != strings.Join(want, ", ") {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+}
@@ -0,0 +1,75 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// Mechanisms returns the SASL mechanisms advertised in the stream features in e.
+func Mechanisms(e Element) []string {
+	n := Tree(e)
+	if n == nil {
+		return nil
+	}
+	var mechanisms []string
+	for _, c := range n.Children {
+		if c.Name.Space == NSSASL && c.Name.Local == "mechanisms" {
+			for _, m := range c.Query(Qualify(NSSASL, "mechanism")) {
+				mechanisms = append(mechanisms, strings.TrimSpace(m))
+			}
+		}
+	}
+	return mechanisms
+}
+
+// WithMechanisms returns a copy of the stream features in e that advertises mechanisms instead of the original SASL mechanisms.
+// e is returned unchanged if it doesn't advertise SASL.
+func WithMechanisms(e Element, mechanisms []string) (Element, error) {
+	buf := new(bytes.Buffer)
+	encoder := xml.NewEncoder(buf)
+	d := xml.NewDecoder(strings.NewReader(e.XML()))
+	depth, skipping := 0, false
+	for {
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t1 := t.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 && isMechanisms(t1) {
+				encodeRawToken(encoder, t1)
+				// Reuse the prefix of the original element so that the replacement resolves to the same namespace
+				name := xml.Name{Space: t1.Name.Space, Local: "mechanism"}
+				for _, m := range mechanisms {
+					encodeRawToken(encoder, xml.StartElement{Name: name})
+					encoder.EncodeToken(xml.CharData(m))
+					encodeRawToken(encoder, xml.EndElement{Name: name})
+				}
+				skipping = true
+				continue
+			}
+		case xml.EndElement:
+			depth--
+			if skipping && depth == 1 {
+				skipping = false
+				encodeRawToken(encoder, t1)
+				continue
+			}
+		}
+		if !skipping {
+			encodeRawToken(encoder, t)
+		}
+	}
+	encoder.Flush()
+	return NewGenericElement(e.Name(), buf.String()), nil
+}
+
+func isMechanisms(se xml.StartElement) bool {
+	return se.Name.Local == "mechanisms" && elementSpace(se) == NSSASL
+}
@@ -0,0 +1,62 @@
+package xmpp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWithMechanisms(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		mechanisms []string // Mechanisms advertised by raw
+		keep       []string
+		want       string
+	}{
+		{
+			name:       "default namespace",
+			raw:        `<stream:features xmlns:stream='http://etherx.jabber.org/streams'><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism> SCRAM-SHA-1-PLUS </mechanism><mechanism>SCRAM-SHA-1</mechanism></mechanisms><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>`,
+			mechanisms: []string{"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"},
+			keep:       []string{"SCRAM-SHA-1"},
+			want:       `<mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>SCRAM-SHA-1</mechanism></mechanisms><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"></bind>`,
+		},
+		{
+			name:       "prefixed",
+			raw:        `<stream:features xmlns:stream='http://etherx.jabber.org/streams'><sasl:mechanisms xmlns:sasl='urn:ietf:params:xml:ns:xmpp-sasl'><sasl:mechanism>PLAIN</sasl:mechanism><sasl:mechanism>EXTERNAL</sasl:mechanism></sasl:mechanisms></stream:features>`,
+			mechanisms: []string{"PLAIN", "EXTERNAL"},
+			keep:       []string{"EXTERNAL"},
+			want:       `<sasl:mechanisms xmlns:sasl="urn:ietf:params:xml:ns:xmpp-sasl"><sasl:mechanism>EXTERNAL</sasl:mechanism></sasl:mechanisms>`,
+		},
+		{
+			name:       "mechanisms of another namespace",
+			raw:        `<stream:features xmlns:stream='http://etherx.jabber.org/streams'><mechanisms xmlns='urn:example'><mechanism>PLAIN</mechanism></mechanisms></stream:features>`,
+			mechanisms: nil,
+			keep:       []string{},
+			want:       `<mechanisms xmlns="urn:example"><mechanism>PLAIN</mechanism></mechanisms>`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := NewDecoder(strings.NewReader(test.raw)).NextElement()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Mechanisms(e); !reflect.DeepEqual(got, test.mechanisms) {
+				t.Errorf("Mechanisms = %q, want %q", got, test.mechanisms)
+			}
+			rewritten, err := WithMechanisms(e, test.keep)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(rewritten.XML(), test.want) {
+				t.Errorf("WithMechanisms = %s, want it to contain %s", rewritten.XML(), test.want)
+			}
+			if test.mechanisms != nil {
+				if got := Mechanisms(rewritten); !reflect.DeepEqual(got, test.keep) {
+					t.Errorf("Mechanisms after rewriting = %q, want %q", got, test.keep)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"strings"
+)
+
+// StanzaError represents the <error/> child of a stanza.
+// https://xmpp.org/rfcs/rfc6120.html#stanzas-error
+type StanzaError struct {
+	Type      string // One of auth, cancel, continue, modify or wait
+	By        string
+	Condition string // Local name of the defined condition e.g. item-not-found
+	Text      string
+}
+
+// Stanza contains the attributes shared by Message, Presence and IQ.
+// The fields are read from the element when it is decoded. Changing them doesn't change the XML of the element.
+type Stanza struct {
+	GenericElement
+	To    string
+	From  string
+	ID    string
+	Type  string
+	Lang  string
+	Error *StanzaError // nil unless the stanza contains an <error/>
+}
+
+// Message is a <message/> stanza.
+type Message struct {
+	Stanza
+}
+
+// Presence is a <presence/> stanza.
+type Presence struct {
+	Stanza
+}
+
+// IQ is an <iq/> stanza.
+type IQ struct {
+	Stanza
+}
+
+func (s *Stanza) stanza() *Stanza {
+	return s
+}
+
+// newStanza returns ge as a *Message, *Presence or *IQ with the stanza attributes and error read from its tree.
+// ge is returned unchanged if it isn't a stanza.
+func newStanza(ge *GenericElement) Element {
+	if !IsStanzaName(ge.name) || ge.tree == nil {
+		return ge
+	}
+	root := ge.tree
+	s := Stanza{GenericElement: *ge}
+	s.To, _ = root.AttrValue("to")
+	s.From, _ = root.AttrValue("from")
+	s.ID, _ = root.AttrValue("id")
+	s.Type, _ = root.AttrValue("type")
+	for _, a := range root.Attr {
+		if a.Name.Space == xmlURL && a.Name.Local == "lang" {
+			s.Lang = a.Value
+		}
+	}
+	// The error is in the namespace of the stanza. An <error/> of a payload namespace is not a stanza error.
+	if errNode := root.Child(Qualify(root.Name.Space, "error")); errNode != nil {
+		s.Error = &StanzaError{}
+		s.Error.Type, _ = errNode.AttrValue("type")
+		s.Error.By, _ = errNode.AttrValue("by")
+		for _, c := range errNode.Children {
+			if c.Name.Space != NSStanzas {
+				continue
+			}
+			if c.Name.Local == "text" {
+				s.Error.Text = c.Text
+			} else if s.Error.Condition == "" {
+				s.Error.Condition = c.Name.Local
+			}
+		}
+	}
+
+	switch ge.name.Local {
+	case "message":
+		return &Message{Stanza: s}
+	case "presence":
+		return &Presence{Stanza: s}
+	default:
+		return &IQ{Stanza: s}
+	}
+}
+
+// IsStanzaName returns true if name is the name of a message, presence or iq stanza.
+// Elements without a namespace are accepted too, since that's how stanzas decoded outside of a stream are named.
+func IsStanzaName(name xml.Name) bool {
+	switch name.Space {
+	case NSClient, NSServer, NSComponentAccept, "":
+	default:
+		return false
+	}
+	switch name.Local {
+	case "message", "presence", "iq":
+		return true
+	}
+	return false
+}
+
+// newElement returns raw as an Element called name. raw is decoded again so that the result carries its tree and has the same type as the original.
+func newElement(name xml.Name, raw string) Element {
+	e, err := NewDecoder(strings.NewReader(raw)).NextElement()
+	if err != nil {
+		return NewGenericElement(name, raw)
+	}
+	// Keep the resolved name, since raw on its own may not declare the namespace.
+	switch e1 := e.(type) {
+	case *GenericElement:
+		e1.name = name
+		return newStanza(e1)
+	case interface{ stanza() *Stanza }:
+		e1.stanza().name = name
+	}
+	return e
+}
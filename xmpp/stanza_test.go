@@ -0,0 +1,116 @@
+package xmpp
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeInStream decodes the first element after the stream header
+func decodeInStream(t *testing.T, header, raw string) Element {
+	t.Helper()
+	d := NewDecoder(strings.NewReader(header + raw))
+	if _, err := d.NextElement(); err != nil {
+		t.Fatal(err)
+	}
+	e, err := d.NextElement()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestStanzaTypes(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   string
+		raw      string
+		wantType string
+		want     Stanza // Only the attributes and error are compared
+	}{
+		{
+			name:     "message",
+			header:   testClientHeader,
+			raw:      `<message to='b@example.com' from='a@example.com/r' id='m1' type='chat' xml:lang='en'><body>hi</body></message>`,
+			wantType: "*xmpp.Message",
+			want:     Stanza{To: "b@example.com", From: "a@example.com/r", ID: "m1", Type: "chat", Lang: "en"},
+		},
+		{
+			name:     "presence without attributes",
+			header:   testClientHeader,
+			raw:      `<presence/>`,
+			wantType: "*xmpp.Presence",
+		},
+		{
+			name:     "iq error",
+			header:   testClientHeader,
+			raw:      `<iq type='error' id='i1'><query xmlns='jabber:iq:roster'/><error type='cancel' by='example.com'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/><text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>not here</text></error></iq>`,
+			wantType: "*xmpp.IQ",
+			want: Stanza{ID: "i1", Type: "error", Error: &StanzaError{
+				Type: "cancel", By: "example.com", Condition: "service-unavailable", Text: "not here",
+			}},
+		},
+		{
+			name:     "condition after text",
+			header:   testClientHeader,
+			raw:      `<message type='error'><error type='modify'><text xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'>bad</text><bad-request xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/><app xmlns='urn:example'/></error></message>`,
+			wantType: "*xmpp.Message",
+			want:     Stanza{Type: "error", Error: &StanzaError{Type: "modify", Condition: "bad-request", Text: "bad"}},
+		},
+		{
+			name:     "server stream",
+			header:   testServerHeader,
+			raw:      `<iq to='example.com' from='example.net' id='s1' type='get'><ping xmlns='urn:xmpp:ping'/></iq>`,
+			wantType: "*xmpp.IQ",
+			want:     Stanza{To: "example.com", From: "example.net", ID: "s1", Type: "get"},
+		},
+		{
+			name:     "message of another namespace",
+			header:   testClientHeader,
+			raw:      `<message xmlns='urn:example' to='b@example.com'/>`,
+			wantType: "*xmpp.GenericElement",
+		},
+		{
+			name:     "not a stanza",
+			header:   testClientHeader,
+			raw:      `<r xmlns='urn:xmpp:sm:3'/>`,
+			wantType: "*xmpp.GenericElement",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e := decodeInStream(t, test.header, test.raw)
+			if got := fmt.Sprintf("%T", e); got != test.wantType {
+				t.Fatalf("decoded %s, want %s", got, test.wantType)
+			}
+			s, ok := e.(interface{ stanza() *Stanza })
+			if !ok {
+				return
+			}
+			got := *s.stanza()
+			got.GenericElement = GenericElement{}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v (error %+v), want %+v (error %+v)", got, got.Error, test.want, test.want.Error)
+			}
+		})
+	}
+}
+
+func TestRewriteKeepsStanzaType(t *testing.T) {
+	e := decodeInStream(t, testClientHeader, `<message to='b@example.com' id='m1'><body>hi</body></message>`)
+	rewritten, err := WithAttr(e, "to", "c@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := rewritten.(*Message)
+	if !ok {
+		t.Fatalf("rewrote to %T, want *xmpp.Message", rewritten)
+	}
+	if m.To != "c@example.com" || m.ID != "m1" {
+		t.Errorf("got to %q and id %q", m.To, m.ID)
+	}
+	if m.Name().Space != NSClient {
+		t.Errorf("got namespace %q, want %q", m.Name().Space, NSClient)
+	}
+}
@@ -8,12 +8,25 @@ import (
 // Stream is a custom Element that represents the start of a stream.
 // Unlike normal XMPP Elements, a Stream's XML() method should not return the closing </stream> tag.
 // Normal XMPP Elements have a depth=1 whereas the start of a stream is depth=0
+// A Stream returned by a Decoder keeps its original bytes, including the XML header, which XML() returns as long as none
+// of the fields have been changed.
 type Stream struct {
 	From    string
 	To      string
 	ID      string
 	Version string
 	rawSE   xml.StartElement
+	raw     string
+	header  string
+	parsed  streamAttrs
+}
+
+// streamAttrs are the values of the Stream fields as they were decoded
+type streamAttrs struct {
+	From    string
+	To      string
+	ID      string
+	Version string
 }
 
 // NewStream returns a new Stream that implements xmpp.Element
@@ -32,9 +45,15 @@ func NewStream(rawSE xml.StartElement) *Stream {
 			stream.Version = attr.Value
 		}
 	}
+	stream.parsed = streamAttrs{From: stream.From, To: stream.To, ID: stream.ID, Version: stream.Version}
 	return &stream
 }
 
+// Namespace returns the default namespace declared by the stream header e.g. jabber:client
+func (s Stream) Namespace() string {
+	return declaredSpace(s.rawSE)
+}
+
 func (s Stream) Name() xml.Name {
 	return xml.Name{
 		Local: "stream",
@@ -43,7 +62,10 @@ func (s Stream) Name() xml.Name {
 }
 
 func (s Stream) XML() string {
-	buf := new(bytes.Buffer)
+	if s.raw != "" && s.parsed == (streamAttrs{From: s.From, To: s.To, ID: s.ID, Version: s.Version}) {
+		return s.raw
+	}
+	buf := bytes.NewBufferString(s.header)
 	encoder := xml.NewEncoder(buf)
 	attrs := make([]xml.Attr, 5)
 	for _, attr := range s.rawSE.Attr {
@@ -70,8 +92,11 @@ func (s Stream) XML() string {
 	return buf.String()
 }
 
-// Empty Struct to represent the end of a stream.
-type StreamEnd struct{}
+// StreamEnd represents the end of a stream. A StreamEnd returned by a Decoder keeps the closing tag it was decoded from,
+// so that the prefix of the stream is kept.
+type StreamEnd struct {
+	xml string
+}
 
 func (s StreamEnd) Name() xml.Name {
 	return xml.Name{
@@ -81,5 +106,24 @@ func (s StreamEnd) Name() xml.Name {
 }
 
 func (s StreamEnd) XML() string {
-	return "</stream>"
+	if s.xml != "" {
+		return s.xml
+	}
+	return "</stream:stream>"
+}
+
+// Whitespace represents whitespace between the elements of a stream. Clients and servers send it to keep idle connections alive.
+type Whitespace struct {
+	xml string
+}
+
+func (w Whitespace) Name() xml.Name {
+	return xml.Name{
+		Local: "whitespace",
+		Space: NSStream,
+	}
+}
+
+func (w Whitespace) XML() string {
+	return w.xml
 }